@@ -0,0 +1,471 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/errm/ekstrap/pkg/config"
+	"github.com/errm/ekstrap/pkg/eks"
+	"github.com/errm/ekstrap/pkg/facts"
+	"github.com/errm/ekstrap/pkg/file"
+	"github.com/errm/ekstrap/pkg/imds"
+	"github.com/errm/ekstrap/pkg/node"
+	"github.com/errm/ekstrap/pkg/system"
+	"github.com/errm/ekstrap/pkg/token"
+	"github.com/errm/ekstrap/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	eksSvc "github.com/aws/aws-sdk-go/service/eks"
+	"github.com/coreos/go-systemd/dbus"
+)
+
+func runCommand(args []string) error {
+	flags := newFlagSet("run", `Configures this node to join its EKS cluster, then (re)starts the kubelet.
+
+The kubelet is only restarted if any of its config files changed, unless
+-force-restart is used. ekstrap waits for the kubelet to become active, and if
+it doesn't, shows why using its state and journal.
+
+Once restarted the kubelet has to stay active for -healthy-for, if it doesn't
+the previous config is restored, the kubelet is restarted again, and ekstrap
+exits with 5.`)
+	cfgFlags := config.AddFlags(flags)
+	timeout := addTimeoutFlag(flags)
+	forceRestart := flags.Bool("force-restart", false, "restart the kubelet even if none of its config files changed")
+	startTimeout := flags.Duration("start-timeout", system.DefaultStartTimeout, "how long to wait for the kubelet to become active after it is (re)started")
+	healthyFor := flags.Duration("healthy-for", system.DefaultHealthyFor, "how long the kubelet has to stay active after it is restarted, 0 means it isn't checked")
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	if *startTimeout <= 0 {
+		return usageError{message: "-start-timeout must be greater than 0"}
+	}
+	if *healthyFor < 0 {
+		return usageError{message: "-healthy-for must not be negative"}
+	}
+
+	cfg, err := cfgFlags.Load(config.Config{})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := newContext(*timeout)
+	defer cancel()
+
+	systemdDbus, err := dbus.New()
+	if err != nil {
+		return err
+	}
+	defer systemdDbus.Close()
+
+	systemd := &system.Systemd{Conn: systemdDbus, StartTimeout: *startTimeout, HealthyFor: *healthyFor, Unit: system.CurrentUnit()}
+	containerRuntime, err := systemd.ContainerRuntime()
+	if err != nil {
+		return err
+	}
+
+	instance, cluster, err := discover(ctx, containerRuntime, cfg)
+	if err != nil {
+		return err
+	}
+	checkEkstrapPath(instance.EkstrapPath())
+
+	system := system.System{
+		Filesystem: &file.Transaction{
+			Context:    file.DefaultContext,
+			Manifest:   system.DefaultManifest,
+			Drift:      file.DriftPolicy(instance.Config.DriftPolicy),
+			Generation: system.DefaultGeneration,
+		},
+		Hostname:     systemd,
+		Init:         systemd,
+		Overlay:      overlay(instance.Config),
+		ForceRestart: *forceRestart,
+	}
+
+	err = system.Configure(ctx, instance, cluster)
+	if err != nil && ctx.Err() != nil {
+		// the phaseError only says what we were doing, so log what happened to the config
+		log.Print(err)
+	}
+	return during(ctx, "configuring the system", err)
+}
+
+// checkEkstrapPath warns if the kubelet won't be able to run the ekstrap
+// binary that is running now to get a token
+func checkEkstrapPath(path string) {
+	running, err := os.Executable()
+	if err != nil {
+		return
+	}
+	installed, ierr := os.Stat(path)
+	current, cerr := os.Stat(running)
+	if ierr == nil && cerr == nil && os.SameFile(installed, current) {
+		return
+	}
+	log.Printf("The kubelet will run ekstrap from %s to get a token, but ekstrap is running from %s, set ekstrapPath if it is installed somewhere else", path, running)
+}
+
+func rollbackCommand(args []string) error {
+	flags := newFlagSet("rollback", `Restores the config files that were replaced the last time run changed them,
+then restarts the services that use them, and the kubelet.
+
+The files that are replaced by the rollback are kept in their place, so
+running rollback again undoes it.`)
+	cfgFlags := config.AddFlags(flags)
+	timeout := addTimeoutFlag(flags)
+	startTimeout := flags.Duration("start-timeout", system.DefaultStartTimeout, "how long to wait for the kubelet to become active after it is restarted")
+	healthyFor := flags.Duration("healthy-for", system.DefaultHealthyFor, "how long the kubelet has to stay active after it is restarted, 0 means it isn't checked")
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	if *startTimeout <= 0 {
+		return usageError{message: "-start-timeout must be greater than 0"}
+	}
+	if *healthyFor < 0 {
+		return usageError{message: "-healthy-for must not be negative"}
+	}
+
+	cfg, err := cfgFlags.Load(config.Config{})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := newContext(*timeout)
+	defer cancel()
+
+	systemdDbus, err := dbus.New()
+	if err != nil {
+		return err
+	}
+	defer systemdDbus.Close()
+
+	systemd := &system.Systemd{Conn: systemdDbus, StartTimeout: *startTimeout, HealthyFor: *healthyFor, Unit: system.CurrentUnit()}
+	system := system.System{
+		Filesystem: &file.Transaction{
+			Context:    file.DefaultContext,
+			Manifest:   system.DefaultManifest,
+			Drift:      file.DriftPolicy(cfg.DriftPolicy),
+			Generation: system.DefaultGeneration,
+		},
+		Init:    systemd,
+		Overlay: overlay(cfg),
+	}
+	return during(ctx, "restoring the previous config", system.Restore(ctx))
+}
+
+func renderCommand(args []string) error {
+	flags := newFlagSet("render", `Renders the config files that run would write for this node, without
+changing the hostname or restarting any services.
+
+By default the files are printed to stdout as a stream of documents, each
+preceded by a header with its path and permissions. With -format=tar they are
+written to stdout as a tar archive instead. With -output-dir the files are
+written to their paths under that directory.`)
+	source := addSourceFlags(flags)
+	outputDir := flags.String("output-dir", "", "write the files under this directory rather than to stdout")
+	format := flags.String("format", "multidoc", "format to print the files to stdout with: multidoc or tar")
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	if *format != "multidoc" && *format != "tar" {
+		return usageError{message: fmt.Sprintf("unknown format %q, expected multidoc or tar", *format)}
+	}
+	if *outputDir != "" && *format != "multidoc" {
+		return usageError{message: "-format cannot be used with -output-dir"}
+	}
+
+	ctx, cancel := newContext(*source.timeout)
+	defer cancel()
+	instance, cluster, err := source.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *outputDir != "":
+		system := system.System{Filesystem: &file.Atomic{Root: *outputDir}, Overlay: overlay(instance.Config)}
+		return system.Write(instance, cluster)
+	case *format == "tar":
+		archive := file.NewTar(os.Stdout)
+		system := system.System{Filesystem: archive, Overlay: overlay(instance.Config)}
+		if err := system.Write(instance, cluster); err != nil {
+			return err
+		}
+		return archive.Close()
+	default:
+		system := system.System{Filesystem: file.Printer{Out: os.Stdout}, Overlay: overlay(instance.Config)}
+		return system.Write(instance, cluster)
+	}
+}
+
+func diffCommand(args []string) error {
+	flags := newFlagSet("diff", "Shows the changes that run would make to the config files on this node, without making them.")
+	source := addSourceFlags(flags)
+	contextLines := flags.Int("context", file.DefaultContext, "number of unchanged `lines` to show around each change")
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	if *contextLines < 0 {
+		return usageError{message: "-context cannot be negative"}
+	}
+
+	ctx, cancel := newContext(*source.timeout)
+	defer cancel()
+	instance, cluster, err := source.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	atomic := &file.Atomic{
+		DryRun:   true,
+		Context:  *contextLines,
+		Manifest: system.DefaultManifest,
+		Drift:    file.DriftPolicy(instance.Config.DriftPolicy),
+	}
+	system := system.System{Filesystem: atomic, Overlay: overlay(instance.Config)}
+	return system.Write(instance, cluster)
+}
+
+func factsCommand(args []string) error {
+	flags := newFlagSet("facts", `Shows what ekstrap has discovered about this node and its cluster.
+
+With -format=json the facts are printed as a snapshot, that can be used with
+the -facts flag of render, diff or facts to reproduce this node's config
+without access to AWS.`)
+	source := addSourceFlags(flags)
+	format := flags.String("format", "text", "format to print the facts with: text, or json to save a snapshot that can be used with -facts")
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+
+	if *format != "text" && *format != "json" {
+		return usageError{message: fmt.Sprintf("unknown format %q, expected text or json", *format)}
+	}
+
+	ctx, cancel := newContext(*source.timeout)
+	defer cancel()
+	instance, cluster, err := source.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		return facts.New(instance, cluster, version).Write(os.Stdout)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Cluster:\t%s\n", aws.StringValue(cluster.Name))
+	fmt.Fprintf(w, "Endpoint:\t%s\n", aws.StringValue(cluster.Endpoint))
+	fmt.Fprintf(w, "Cluster version:\t%s\n", aws.StringValue(cluster.Version))
+	fmt.Fprintf(w, "Region:\t%s\n", instance.Region)
+	fmt.Fprintf(w, "Instance ID:\t%s\n", aws.StringValue(instance.InstanceId))
+	fmt.Fprintf(w, "Instance type:\t%s\n", aws.StringValue(instance.InstanceType))
+	fmt.Fprintf(w, "Private IP:\t%s\n", aws.StringValue(instance.PrivateIpAddress))
+	fmt.Fprintf(w, "Private DNS name:\t%s\n", aws.StringValue(instance.PrivateDnsName))
+	fmt.Fprintf(w, "Spot:\t%t\n", instance.Spot())
+	fmt.Fprintf(w, "Container runtime:\t%s\n", instance.ContainerRuntime)
+	fmt.Fprintf(w, "Kubelet version:\t%s\n", instance.Version())
+	fmt.Fprintf(w, "Cluster DNS:\t%s\n", instance.ClusterDNS())
+	fmt.Fprintf(w, "Max pods:\t%d\n", instance.MaxPods())
+	fmt.Fprintf(w, "Reserved CPU:\t%s\n", instance.ReservedCPU())
+	fmt.Fprintf(w, "Reserved memory:\t%s\n", instance.ReservedMemory())
+	fmt.Fprintf(w, "Pause image:\t%s\n", instance.PauseImage())
+	fmt.Fprintf(w, "Labels:\t%s\n", strings.Join(instance.Labels(), ","))
+	fmt.Fprintf(w, "Taints:\t%s\n", strings.Join(instance.Taints(), ","))
+	return w.Flush()
+}
+
+func tokenCommand(args []string) error {
+	flags := newFlagSet("token", `Prints a token to authenticate with an EKS cluster, using this node's AWS credentials.
+
+The token is printed as an ExecCredential, so ekstrap can be used as a
+credential plugin in a kubeconfig, instead of aws-iam-authenticator.`)
+	clusterName := flags.String("cluster-name", "", "name of the EKS cluster to authenticate with (required)")
+	region := flags.String("region", "", "region of the STS endpoint to use, the global endpoint is used if unset")
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	if *clusterName == "" {
+		return usageError{message: "-cluster-name is required"}
+	}
+
+	ctx, cancel := newContext(0)
+	defer cancel()
+	generator := token.Generator{
+		Credentials: imds.New().Credentials(ctx),
+		Region:      *region,
+	}
+	t, err := generator.Get(*clusterName)
+	if err != nil {
+		return err
+	}
+	return t.WriteExecCredential(os.Stdout, token.APIVersion(os.Getenv("KUBERNETES_EXEC_INFO")))
+}
+
+func versionCommand(args []string) error {
+	flags := newFlagSet("version", "Prints the version of ekstrap.")
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	fmt.Printf("ekstrap %s (commit: %s, built: %s)\n", version, commit, date)
+	return nil
+}
+
+// overlay returns the directory of templates set in the config, or the default
+func overlay(cfg config.Config) string {
+	if cfg.TemplatesDir != "" {
+		return cfg.TemplatesDir
+	}
+	return system.DefaultOverlay
+}
+
+// source holds the flags that control where the facts about the node come from
+type source struct {
+	runtime string
+	facts   string
+	config  *config.Flags
+	timeout *time.Duration
+}
+
+func addSourceFlags(flags *flag.FlagSet) *source {
+	s := &source{config: config.AddFlags(flags), timeout: addTimeoutFlag(flags)}
+	flags.StringVar(&s.runtime, "container-runtime", "", "container runtime (docker, containerd or crio), detected with systemd if unset")
+	flags.StringVar(&s.facts, "facts", "", "read facts from a snapshot `file` saved with facts -format=json, rather than discovering them")
+	return s
+}
+
+// discover returns the node and cluster, either from a facts snapshot, or by
+// discovering them from AWS.
+//
+// When using a snapshot the config it was captured with is used, but can
+// still be overridden by a local config file, environment or flags.
+func (s *source) discover(ctx context.Context) (*node.Node, *eksSvc.Cluster, error) {
+	if s.facts == "" {
+		cfg, err := s.config.Load(config.Config{})
+		if err != nil {
+			return nil, nil, err
+		}
+		runtime, err := s.containerRuntime()
+		if err != nil {
+			return nil, nil, err
+		}
+		return discover(ctx, runtime, cfg)
+	}
+	f, err := os.Open(s.facts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	snapshot, err := facts.Read(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	instance := snapshot.Node()
+	if instance.Config, err = s.config.Load(instance.Config); err != nil {
+		return nil, nil, err
+	}
+	if s.runtime != "" {
+		instance.ContainerRuntime = s.runtime
+	}
+	return instance, snapshot.Cluster, nil
+}
+
+// containerRuntime returns the runtime set with -container-runtime, or if
+// it is unset asks systemd which container runtime is installed.
+func (s *source) containerRuntime() (string, error) {
+	if s.runtime != "" {
+		return s.runtime, nil
+	}
+	systemdDbus, err := dbus.New()
+	if err != nil {
+		return "", err
+	}
+	defer systemdDbus.Close()
+	systemd := &system.Systemd{Conn: systemdDbus}
+	return systemd.ContainerRuntime()
+}
+
+// discover queries the AWS APIs for the node we are running on and the
+// EKS cluster that it belongs to.
+//
+// If ctx is done while waiting for the instance to be tagged, or for the
+// cluster to become active, the error describes what we were waiting for.
+func discover(ctx context.Context, containerRuntime string, cfg config.Config) (*node.Node, *eksSvc.Cluster, error) {
+	metadata := imds.New()
+	region, err := metadata.Region(ctx)
+	if err != nil && ctx.Err() != nil {
+		return nil, nil, during(ctx, "waiting for the ec2 metadata service", err)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("I don't seem to be running on an AWS EC2 instance, can't reach the ec2 metadata service: %v", err)
+	}
+	if !util.IsAWSRegion(region) {
+		return nil, nil, fmt.Errorf("the ec2 metadata service returned an invalid region: %q", region)
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Region:      &region,
+		Credentials: metadata.Credentials(ctx),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var instance *node.Node
+	if cfg.FactsSource == config.FactsSourceMetadata {
+		instance, err = node.FromMetadata(ctx, metadata, &region, containerRuntime, cfg)
+	} else {
+		instance, err = node.New(ctx, ec2.New(sess), metadata, &region, containerRuntime, cfg)
+	}
+	if err != nil {
+		return nil, nil, during(ctx, "waiting for the kubernetes.io/cluster/<name> tag to be set on this instance", err)
+	}
+
+	cluster, err := eks.Cluster(ctx, eksSvc.New(sess), instance.ClusterName())
+	if err != nil {
+		return nil, nil, during(ctx, fmt.Sprintf("waiting for the EKS cluster %s to become ACTIVE", instance.ClusterName()), err)
+	}
+
+	if cfg.KubeletVersion == "" {
+		instance.KubeletVersion = kubeletVersion(cluster)
+	}
+	for _, warning := range instance.VersionWarnings(aws.StringValue(cluster.Version)) {
+		log.Print(warning)
+	}
+	return instance, cluster, nil
+}
+
+// kubeletVersion returns the version of the installed kubelet, or if we
+// can't run it, the version of the control plane that it should match.
+func kubeletVersion(cluster *eksSvc.Cluster) string {
+	version, err := system.KubeletVersion(system.KubeletPath)
+	if err != nil {
+		log.Printf("%v, assuming it is the same version as the EKS control plane", err)
+		return aws.StringValue(cluster.Version)
+	}
+	return version
+}
@@ -10,4 +10,5 @@ require (
 	github.com/jmespath/go-jmespath v0.0.0-20160202185014-0b12d6b521d8
 	github.com/pkg/errors v0.8.1
 	golang.org/x/sys v0.0.0-20190116161447-11f53e031339 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
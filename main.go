@@ -19,58 +19,223 @@ package main
 //go:generate packr2
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/errm/ekstrap/pkg/eks"
-	"github.com/errm/ekstrap/pkg/file"
-	"github.com/errm/ekstrap/pkg/node"
 	"github.com/errm/ekstrap/pkg/system"
-	"github.com/errm/ekstrap/pkg/util"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
-	eksSvc "github.com/aws/aws-sdk-go/service/eks"
-	"github.com/coreos/go-systemd/dbus"
 )
 
-var metadata = ec2metadata.New(session.Must(session.NewSession()))
-var sess = session.Must(session.NewSession(&aws.Config{Region: region()}))
+// These are set at build time by goreleaser
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// Exit codes, these are part of our interface so should not be changed
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitUsage       = 2
+	exitTimeout     = 3
+	exitInterrupted = 4
+	exitRolledBack  = 5
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{name: "run", summary: "Configure this node to join its EKS cluster (default)", run: runCommand},
+	{name: "rollback", summary: "Restore the config files that run last replaced", run: rollbackCommand},
+	{name: "render", summary: "Render the config files for this node to stdout", run: renderCommand},
+	{name: "diff", summary: "Show the changes that run would make, without making them", run: diffCommand},
+	{name: "facts", summary: "Show what ekstrap has discovered about this node and its cluster", run: factsCommand},
+	{name: "token", summary: "Print a token to authenticate with an EKS cluster, as an exec credential plugin", run: tokenCommand},
+	{name: "version", summary: "Print the version of ekstrap", run: versionCommand},
+}
+
+// usageError is returned when ekstrap has been invoked incorrectly
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+// phaseError is returned when ekstrap runs out of time, or is interrupted,
+// so we can tell the user what it was doing at the time.
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e phaseError) Error() string {
+	if e.err == context.DeadlineExceeded {
+		return "timed out " + e.phase
+	}
+	return "interrupted " + e.phase
+}
 
-func region() *string {
-	region, err := metadata.Region()
-	if err != nil || !util.IsAWSRegion(region) {
-		log.Fatal("I don't seem to be running on an AWS EC2 instance. Can't reach the ec2 metadata service, or it's output seems to be invalid!")
+// during wraps err in a phaseError if it was caused by ctx being done
+func during(ctx context.Context, phase string, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return phaseError{phase: phase, err: ctx.Err()}
 	}
-	return &region
+	return err
 }
 
 func main() {
-	systemdDbus, err := dbus.New()
-	check(err)
+	os.Exit(execute(os.Args[1:]))
+}
 
-	systemd := &system.Systemd{Conn: systemdDbus}
-	containerRuntime, err := systemd.ContainerRuntime()
-	check(err)
+// execute runs the command given by args and returns the exit code.
+//
+// If no command is given we default to run, so ekstrap continues to work
+// when invoked without arguments from a systemd unit.
+func execute(args []string) int {
+	name := "run"
+	if len(args) > 0 {
+		switch args[0] {
+		case "-h", "-help", "--help":
+			usage(os.Stdout)
+			return exitOK
+		case "help":
+			return help(args[1:])
+		}
+		if !strings.HasPrefix(args[0], "-") {
+			name, args = args[0], args[1:]
+		}
+	}
+	for _, c := range commands {
+		if c.name == name {
+			return exitCode(c.run(args))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "ekstrap: unknown command %q\n\n", name)
+	usage(os.Stderr)
+	return exitUsage
+}
 
-	instance, err := node.New(ec2.New(sess), metadata, region(), containerRuntime)
-	check(err)
+func help(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return exitOK
+	}
+	return execute([]string{args[0], "-h"})
+}
 
-	cluster, err := eks.Cluster(eksSvc.New(sess), instance.ClusterName())
-	check(err)
+func exitCode(err error) int {
+	if err == nil || err == flag.ErrHelp {
+		return exitOK
+	}
+	if _, ok := err.(usageError); ok {
+		fmt.Fprintf(os.Stderr, "ekstrap: %v\n", err)
+		return exitUsage
+	}
+	log.Print(err)
+	if _, ok := err.(system.RollbackError); ok {
+		return exitRolledBack
+	}
+	if perr, ok := err.(phaseError); ok {
+		if perr.err == context.DeadlineExceeded {
+			return exitTimeout
+		}
+		return exitInterrupted
+	}
+	return exitError
+}
 
-	system := system.System{
-		Filesystem: &file.Atomic{},
-		Hostname:   systemd,
-		Init:       systemd,
+// newContext returns a context that is cancelled if ekstrap receives
+// SIGINT or SIGTERM, or once timeout has passed. A timeout of 0 means
+// there is no timeout.
+func newContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, aborting", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
 	}
+}
 
-	check(system.Configure(instance, cluster))
+func addTimeoutFlag(flags *flag.FlagSet) *time.Duration {
+	return flags.Duration("timeout", 0, "give up if ekstrap hasn't finished within this `duration` e.g. 10m, 0 means wait forever")
 }
 
-func check(err error) {
+func usage(w io.Writer) {
+	fmt.Fprint(w, "ekstrap bootstraps the configuration of Kubernetes nodes so that they may join an EKS cluster.\n\n")
+	fmt.Fprint(w, "Usage:\n  ekstrap [command] [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s%s\n", c.name, c.summary)
+	}
+	fmt.Fprint(w, "\nUse \"ekstrap help [command]\" for more information about a command.\n")
+	fmt.Fprint(w, "\nExit codes:\n  0  success\n  1  an error occurred\n  2  invalid usage\n  3  timed out\n  4  interrupted by SIGINT or SIGTERM\n  5  the kubelet failed with the new config, so the previous config was restored\n")
+}
+
+// newFlagSet returns a FlagSet for the named command, that prints a
+// description of the command along with its flags when -h is passed.
+func newFlagSet(name, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n  ekstrap %s [flags]\n\n%s\n", name, description)
+		if hasFlags(flags) {
+			fmt.Fprint(flags.Output(), "\nFlags:\n")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+// parse parses args with flags, since none of our commands take
+// positional arguments any that are left over are a usage error.
+func parse(flags *flag.FlagSet, args []string) error {
+	flags.SetOutput(ioutil.Discard)
+	err := flags.Parse(args)
+	flags.SetOutput(os.Stdout)
+	if err == flag.ErrHelp {
+		flags.Usage()
+		return err
+	}
 	if err != nil {
-		log.Fatal(err)
+		return usageError{message: err.Error()}
+	}
+	if flags.NArg() > 0 {
+		return usageError{message: fmt.Sprintf("unexpected argument %q for ekstrap %s", flags.Arg(0), flags.Name())}
 	}
+	return nil
+}
+
+func hasFlags(flags *flag.FlagSet) bool {
+	found := false
+	flags.VisitAll(func(*flag.Flag) { found = true })
+	return found
 }
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/errm/ekstrap/pkg/system"
+)
+
+func TestExecute(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		args     []string
+		expected int
+	}{
+		{desc: "unknown command", args: []string{"frobnicate"}, expected: exitUsage},
+		{desc: "stray positional argument", args: []string{"version", "extra"}, expected: exitUsage},
+		{desc: "unknown flag", args: []string{"version", "-verbose"}, expected: exitUsage},
+		{desc: "invalid flag value", args: []string{"render", "-format", "xml"}, expected: exitUsage},
+		{desc: "help flag", args: []string{"-h"}, expected: exitOK},
+		{desc: "help", args: []string{"help"}, expected: exitOK},
+		{desc: "help for a command", args: []string{"help", "version"}, expected: exitOK},
+		{desc: "command help flag", args: []string{"diff", "-h"}, expected: exitOK},
+		{desc: "version", args: []string{"version"}, expected: exitOK},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			if code := execute(tC.args); code != tC.expected {
+				t.Errorf("expected exit code %d, got %d", tC.expected, code)
+			}
+		})
+	}
+}
+
+func TestExecuteDefaultsToRun(t *testing.T) {
+	defer func(original []command) { commands = original }(commands)
+	var ran [][]string
+	commands = []command{{name: "run", run: func(args []string) error {
+		ran = append(ran, args)
+		return nil
+	}}}
+
+	if code := execute(nil); code != exitOK {
+		t.Errorf("expected exit code %d, got %d", exitOK, code)
+	}
+	if code := execute([]string{"-force-restart"}); code != exitOK {
+		t.Errorf("expected exit code %d, got %d", exitOK, code)
+	}
+	expected := [][]string{nil, {"-force-restart"}}
+	if !reflect.DeepEqual(ran, expected) {
+		t.Errorf("expected run to be called with %v, got %v", expected, ran)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		err      error
+		expected int
+	}{
+		{desc: "success", expected: exitOK},
+		{desc: "help", err: flag.ErrHelp, expected: exitOK},
+		{desc: "error", err: errors.New("something went wrong"), expected: exitError},
+		{desc: "usage", err: usageError{message: "unexpected argument"}, expected: exitUsage},
+		{desc: "timeout", err: phaseError{phase: "waiting", err: context.DeadlineExceeded}, expected: exitTimeout},
+		{desc: "interrupted", err: phaseError{phase: "waiting", err: context.Canceled}, expected: exitInterrupted},
+		{desc: "rolled back", err: system.RollbackError{Err: errors.New("couldn't restart kubelet.service")}, expected: exitRolledBack},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			if code := exitCode(tC.err); code != tC.expected {
+				t.Errorf("expected exit code %d, got %d", tC.expected, code)
+			}
+		})
+	}
+}
+
+func TestUnitOrdering(t *testing.T) {
+	unit, err := ioutil.ReadFile("systemd/ekstrap.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ekstrap waits for the kubelet to start, so the kubelet can't be ordered after it
+	if strings.Contains(string(unit), "Before=kubelet.service") {
+		t.Error("expected ekstrap.service not to be ordered before kubelet.service")
+	}
+	readme, err := ioutil.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(readme), "```systemd\n"+string(unit)+"```") {
+		t.Error("expected the unit in README.md to match systemd/ekstrap.service")
+	}
+}
+
+func TestDuring(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	err := errors.New("couldn't restart kubelet.service: context canceled")
+	if during(ctx, "configuring the system", err) != err {
+		t.Error("expected the error not to be wrapped while the context isn't done")
+	}
+	cancel()
+	wrapped := during(ctx, "configuring the system", system.RollbackError{Err: err})
+	if code := exitCode(wrapped); code != exitInterrupted {
+		t.Errorf("expected exit code %d after being interrupted and rolling back, got %d", exitInterrupted, code)
+	}
+	if during(ctx, "configuring the system", nil) != nil {
+		t.Error("expected no error")
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package backoff
 
 import (
+	"context"
 	"math/rand"
 	"time"
 )
@@ -38,6 +39,19 @@ func (b Backoff) Duration(n int) time.Duration {
 	return jittered(b.Seq[n-1])
 }
 
+// Wait waits for the duration d, as returned by Duration.
+// If ctx is done before then, it returns early with the reason from ctx.
+func Wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func jittered(t int) time.Duration {
 	if t == 0 {
 		return time.Duration(0)
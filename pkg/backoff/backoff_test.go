@@ -17,6 +17,7 @@ limitations under the License.
 package backoff_test
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -56,6 +57,20 @@ func TestJitteredBackoff(t *testing.T) {
 
 }
 
+func TestWait(t *testing.T) {
+	if err := backoff.Wait(context.Background(), 0); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := backoff.Wait(ctx, time.Minute); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	between(t, time.Since(start), 10*time.Millisecond, time.Second)
+}
+
 func between(t *testing.T, actual, low, high time.Duration) {
 	if actual < low {
 		t.Fatalf("Got %s, Expecting >= %s", actual, low)
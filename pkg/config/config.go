@@ -0,0 +1,431 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultPath is where ekstrap looks for its config file if no other path is given
+const DefaultPath = "/etc/ekstrap/config.yaml"
+
+// The places that facts about the instance can be discovered from
+const (
+	FactsSourceEC2      = "ec2"
+	FactsSourceMetadata = "metadata"
+)
+
+// Config overrides the values that ekstrap would otherwise work out from the
+// EC2 instance and its tags. Any value that is left empty is computed as usual.
+//
+// Values are taken from, in order of precedence:
+//
+// * command line flags e.g. -max-pods=110
+// * environment variables e.g. EKSTRAP_MAX_PODS=110
+// * the config file e.g. maxPods: 110
+type Config struct {
+	ClusterName         string            `yaml:"clusterName,omitempty" json:"clusterName,omitempty"`
+	ClusterDNS          string            `yaml:"clusterDNS,omitempty" json:"clusterDNS,omitempty"`
+	MaxPods             int               `yaml:"maxPods,omitempty" json:"maxPods,omitempty"`
+	KubeReserved        Reserved          `yaml:"kubeReserved,omitempty" json:"kubeReserved,omitempty"`
+	EvictionHard        map[string]string `yaml:"evictionHard,omitempty" json:"evictionHard,omitempty"`
+	PauseImage          string            `yaml:"pauseImage,omitempty" json:"pauseImage,omitempty"`
+	PauseImageTag       string            `yaml:"pauseImageTag,omitempty" json:"pauseImageTag,omitempty"`
+	PauseImageMultiArch bool              `yaml:"pauseImageMultiArch,omitempty" json:"pauseImageMultiArch,omitempty"`
+	FactsSource         string            `yaml:"factsSource,omitempty" json:"factsSource,omitempty"`
+	KubeletVersion      string            `yaml:"kubeletVersion,omitempty" json:"kubeletVersion,omitempty"`
+	ExecAPIVersion      string            `yaml:"execAPIVersion,omitempty" json:"execAPIVersion,omitempty"`
+	TemplatesDir        string            `yaml:"templatesDir,omitempty" json:"templatesDir,omitempty"`
+	DriftPolicy         string            `yaml:"driftPolicy,omitempty" json:"driftPolicy,omitempty"`
+	CgroupDriver        string            `yaml:"cgroupDriver,omitempty" json:"cgroupDriver,omitempty"`
+	// RegistryMirrors are the endpoints that the container runtime pulls
+	// images from, instead of the registry, by the registry's host name
+	RegistryMirrors map[string][]string `yaml:"registryMirrors,omitempty" json:"registryMirrors,omitempty"`
+	// InsecureRegistries are registries that docker pulls images from without verifying TLS
+	InsecureRegistries []string `yaml:"insecureRegistries,omitempty" json:"insecureRegistries,omitempty"`
+	// EkstrapPath is where the kubelet runs ekstrap from to get a token
+	EkstrapPath string `yaml:"ekstrapPath,omitempty" json:"ekstrapPath,omitempty"`
+}
+
+// Reserved is the amount of resources to reserve for Kubernetes system daemons
+type Reserved struct {
+	CPU    string `yaml:"cpu,omitempty" json:"cpu,omitempty"`
+	Memory string `yaml:"memory,omitempty" json:"memory,omitempty"`
+}
+
+// setting describes a value that can be set with a flag or environment variable
+type setting struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+	// boolean settings can be set with just -name, like boolean flags
+	boolean bool
+}
+
+var settings = []setting{
+	{
+		name:  "cluster-name",
+		usage: "name of the EKS cluster, rather than reading it from the kubernetes.io/cluster/<name> tag",
+		set:   func(c *Config, v string) error { c.ClusterName = v; return nil },
+	},
+	{
+		name:  "cluster-dns",
+		usage: "IP address of the cluster DNS service",
+		set:   func(c *Config, v string) error { c.ClusterDNS = v; return nil },
+	},
+	{
+		name:  "max-pods",
+		usage: "maximum number of pods that can run on this node",
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%q is not a whole number", v)
+			}
+			c.MaxPods = n
+			return nil
+		},
+	},
+	{
+		name:  "kube-reserved-cpu",
+		usage: "CPU to reserve for Kubernetes system daemons e.g. 100m",
+		set:   func(c *Config, v string) error { c.KubeReserved.CPU = v; return nil },
+	},
+	{
+		name:  "kube-reserved-memory",
+		usage: "memory to reserve for Kubernetes system daemons e.g. 1024Mi",
+		set:   func(c *Config, v string) error { c.KubeReserved.Memory = v; return nil },
+	},
+	{
+		name:  "eviction-hard",
+		usage: "hard eviction thresholds e.g. memory.available=200Mi,nodefs.available=5%",
+		set: func(c *Config, v string) error {
+			thresholds := make(map[string]string)
+			for _, pair := range strings.Split(v, ",") {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					return fmt.Errorf("%q should be in the form signal=threshold", pair)
+				}
+				thresholds[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+			c.EvictionHard = thresholds
+			return nil
+		},
+	},
+	{
+		name:  "pause-image",
+		usage: "image to use as the pod-infra-container-image",
+		set:   func(c *Config, v string) error { c.PauseImage = v; return nil },
+	},
+	{
+		name:  "pause-image-tag",
+		usage: "tag of the EKS pause image, rather than the one for the kubelet's version",
+		set:   func(c *Config, v string) error { c.PauseImageTag = v; return nil },
+	},
+	{
+		name:    "pause-image-multi-arch",
+		usage:   "use the multi-arch EKS pause image, rather than the one for this node's architecture",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			multiArch, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%q is not true or false", v)
+			}
+			c.PauseImageMultiArch = multiArch
+			return nil
+		},
+	},
+	{
+		name:  "facts-source",
+		usage: "where to discover the instance's details: ec2 (the default), or metadata which needs no EC2 permissions but the cluster name to be set",
+		set:   func(c *Config, v string) error { c.FactsSource = v; return nil },
+	},
+	{
+		name:  "kubelet-version",
+		usage: "version of the kubelet e.g. 1.27, detected by running kubelet --version if unset",
+		set:   func(c *Config, v string) error { c.KubeletVersion = v; return nil },
+	},
+	{
+		name:  "exec-api-version",
+		usage: "client.authentication.k8s.io version the kubelet uses to get a token: v1alpha1, v1beta1 or v1, chosen for the kubelet's version if unset",
+		set:   func(c *Config, v string) error { c.ExecAPIVersion = v; return nil },
+	},
+	{
+		name:  "templates-dir",
+		usage: "directory of templates that override, add to or disable the built in ones (default /etc/ekstrap/templates.d)",
+		set:   func(c *Config, v string) error { c.TemplatesDir = v; return nil },
+	},
+	{
+		name:  "drift-policy",
+		usage: "what to do with a file that has been edited since ekstrap wrote it: warn (the default), refuse to overwrite it, or backup",
+		set:   func(c *Config, v string) error { c.DriftPolicy = v; return nil },
+	},
+	{
+		name:  "cgroup-driver",
+		usage: "cgroup driver used by the kubelet and the container runtime: cgroupfs (the default) or systemd",
+		set:   func(c *Config, v string) error { c.CgroupDriver = v; return nil },
+	},
+	{
+		name:  "registry-mirrors",
+		usage: "mirrors to pull images from e.g. docker.io=https://mirror.example.com,docker.io=https://mirror2.example.com",
+		set: func(c *Config, v string) error {
+			mirrors := make(map[string][]string)
+			for _, pair := range strings.Split(v, ",") {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					return fmt.Errorf("%q should be in the form registry=endpoint", pair)
+				}
+				registry := strings.TrimSpace(kv[0])
+				mirrors[registry] = append(mirrors[registry], strings.TrimSpace(kv[1]))
+			}
+			c.RegistryMirrors = mirrors
+			return nil
+		},
+	},
+	{
+		name:  "insecure-registries",
+		usage: "registries that docker can pull from without verifying TLS e.g. registry.example.com:5000,10.0.0.0/8",
+		set: func(c *Config, v string) error {
+			c.InsecureRegistries = nil
+			for _, registry := range strings.Split(v, ",") {
+				c.InsecureRegistries = append(c.InsecureRegistries, strings.TrimSpace(registry))
+			}
+			return nil
+		},
+	},
+	{
+		name:  "ekstrap-path",
+		usage: "path the kubelet runs ekstrap from to get a token, rather than /usr/sbin/ekstrap",
+		set:   func(c *Config, v string) error { c.EkstrapPath = v; return nil },
+	},
+}
+
+// envName returns the environment variable that can be used for a setting
+// e.g. max-pods can be set with EKSTRAP_MAX_PODS
+func envName(name string) string {
+	return "EKSTRAP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Flags holds any config that is set on the command line
+type Flags struct {
+	path   string
+	values map[string]string
+}
+
+// AddFlags registers a flag for each config setting, and the -config flag
+// that sets the path of the config file.
+func AddFlags(flags *flag.FlagSet) *Flags {
+	f := &Flags{values: make(map[string]string)}
+	flags.StringVar(&f.path, "config", "", "path to the config `file` (default "+DefaultPath+", or $EKSTRAP_CONFIG)")
+	for _, s := range settings {
+		flags.Var(flagValue{name: s.name, values: f.values, boolean: s.boolean}, s.name, s.usage+" (or $"+envName(s.name)+")")
+	}
+	return f
+}
+
+type flagValue struct {
+	name    string
+	values  map[string]string
+	boolean bool
+}
+
+func (v flagValue) String() string {
+	return v.values[v.name]
+}
+
+func (v flagValue) Set(value string) error {
+	v.values[v.name] = value
+	return nil
+}
+
+func (v flagValue) IsBoolFlag() bool {
+	return v.boolean
+}
+
+// Load returns the Config, built from base, the config file, the environment
+// and then the command line flags.
+//
+// It is not an error for the config file to be missing, unless its path was
+// given explicitly. The resulting Config is validated, so if an error is
+// returned it will describe everything that was wrong with it.
+func (f *Flags) Load(base Config) (Config, error) {
+	c := base
+	path, explicit := f.path, true
+	if path == "" {
+		path = os.Getenv("EKSTRAP_CONFIG")
+	}
+	if path == "" {
+		path, explicit = DefaultPath, false
+	}
+	if err := read(&c, path, explicit); err != nil {
+		return c, err
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(envName(s.name)); ok {
+			if err := s.set(&c, value); err != nil {
+				return c, fmt.Errorf("invalid value for %s: %v", envName(s.name), err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, ok := f.values[s.name]; ok {
+			if err := s.set(&c, value); err != nil {
+				return c, fmt.Errorf("invalid value for -%s: %v", s.name, err)
+			}
+		}
+	}
+	return c, c.Validate()
+}
+
+func read(c *Config, path string, explicit bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("couldn't parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+var (
+	clusterNameRE = regexp.MustCompile(`^[0-9A-Za-z][A-Za-z0-9\-_]*$`)
+	cpuRE         = regexp.MustCompile(`^\d+(\.\d+)?m?$`)
+	memoryRE      = regexp.MustCompile(`^\d+(Ki|Mi|Gi|Ti|k|M|G|T)?$`)
+	thresholdRE   = regexp.MustCompile(`^(\d+(\.\d+)?%|\d+(Ki|Mi|Gi|Ti|k|M|G|T)?)$`)
+	tagRE         = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	versionRE     = regexp.MustCompile(`^v?\d+\.\d+(\.\d+)?(-[0-9A-Za-z.-]+)?$`)
+	pathRE        = regexp.MustCompile(`^/[A-Za-z0-9._/+-]*$`)
+	registryRE    = regexp.MustCompile(`^[A-Za-z0-9*][A-Za-z0-9.*-]*(:\d+)?$`)
+)
+
+// evictionSignals are the signals the kubelet supports for hard eviction
+var evictionSignals = map[string]bool{
+	"memory.available":   true,
+	"nodefs.available":   true,
+	"nodefs.inodesFree":  true,
+	"imagefs.available":  true,
+	"imagefs.inodesFree": true,
+	"pid.available":      true,
+}
+
+// Validate checks that the values in the Config make sense
+func (c Config) Validate() error {
+	var problems []string
+	if c.ClusterName != "" && (!clusterNameRE.MatchString(c.ClusterName) || len(c.ClusterName) > 100) {
+		problems = append(problems, fmt.Sprintf("clusterName: %q is not a valid EKS cluster name", c.ClusterName))
+	}
+	if c.ClusterDNS != "" && net.ParseIP(c.ClusterDNS) == nil {
+		problems = append(problems, fmt.Sprintf("clusterDNS: %q is not an IP address", c.ClusterDNS))
+	}
+	if c.MaxPods < 0 {
+		problems = append(problems, fmt.Sprintf("maxPods: %d must not be negative", c.MaxPods))
+	}
+	if c.KubeReserved.CPU != "" && !cpuRE.MatchString(c.KubeReserved.CPU) {
+		problems = append(problems, fmt.Sprintf("kubeReserved.cpu: %q is not a CPU quantity e.g. 100m", c.KubeReserved.CPU))
+	}
+	if c.KubeReserved.Memory != "" && !memoryRE.MatchString(c.KubeReserved.Memory) {
+		problems = append(problems, fmt.Sprintf("kubeReserved.memory: %q is not a memory quantity e.g. 1024Mi", c.KubeReserved.Memory))
+	}
+	signals := make([]string, 0, len(c.EvictionHard))
+	for signal := range c.EvictionHard {
+		signals = append(signals, signal)
+	}
+	sort.Strings(signals)
+	for _, signal := range signals {
+		threshold := c.EvictionHard[signal]
+		if !evictionSignals[signal] {
+			problems = append(problems, fmt.Sprintf("evictionHard: %q is not an eviction signal", signal))
+		} else if !thresholdRE.MatchString(threshold) {
+			problems = append(problems, fmt.Sprintf("evictionHard.%s: %q is not a quantity or percentage", signal, threshold))
+		}
+	}
+	if strings.ContainsAny(c.PauseImage, " \t\n") {
+		problems = append(problems, fmt.Sprintf("pauseImage: %q is not a valid image name", c.PauseImage))
+	}
+	if c.PauseImageTag != "" && !tagRE.MatchString(c.PauseImageTag) {
+		problems = append(problems, fmt.Sprintf("pauseImageTag: %q is not a valid image tag", c.PauseImageTag))
+	}
+	if c.KubeletVersion != "" && !versionRE.MatchString(c.KubeletVersion) {
+		problems = append(problems, fmt.Sprintf("kubeletVersion: %q is not a Kubernetes version e.g. 1.27", c.KubeletVersion))
+	}
+	switch c.ExecAPIVersion {
+	case "", "v1alpha1", "v1beta1", "v1":
+	default:
+		problems = append(problems, fmt.Sprintf("execAPIVersion: %q should be v1alpha1, v1beta1 or v1", c.ExecAPIVersion))
+	}
+	switch c.DriftPolicy {
+	case "", "warn", "refuse", "backup":
+	default:
+		problems = append(problems, fmt.Sprintf("driftPolicy: %q should be warn, refuse or backup", c.DriftPolicy))
+	}
+	switch c.CgroupDriver {
+	case "", "cgroupfs", "systemd":
+	default:
+		problems = append(problems, fmt.Sprintf("cgroupDriver: %q should be cgroupfs or systemd", c.CgroupDriver))
+	}
+	registries := make([]string, 0, len(c.RegistryMirrors))
+	for registry := range c.RegistryMirrors {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	for _, registry := range registries {
+		if !registryRE.MatchString(registry) {
+			problems = append(problems, fmt.Sprintf("registryMirrors: %q is not a registry host name", registry))
+			continue
+		}
+		for _, endpoint := range c.RegistryMirrors[registry] {
+			if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("registryMirrors.%s: %q is not an http(s) URL", registry, endpoint))
+			}
+		}
+	}
+	for _, registry := range c.InsecureRegistries {
+		if _, _, err := net.ParseCIDR(registry); err != nil && (strings.Contains(registry, "*") || !registryRE.MatchString(registry)) {
+			problems = append(problems, fmt.Sprintf("insecureRegistries: %q is not a registry host name or CIDR", registry))
+		}
+	}
+	if c.EkstrapPath != "" && !pathRE.MatchString(c.EkstrapPath) {
+		problems = append(problems, fmt.Sprintf("ekstrapPath: %q is not an absolute path", c.EkstrapPath))
+	}
+	switch c.FactsSource {
+	case "", FactsSourceEC2:
+	case FactsSourceMetadata:
+		if c.ClusterName == "" {
+			problems = append(problems, "clusterName: must be set when factsSource is metadata, as the kubernetes.io/cluster/<name> tag can't be read from instance metadata")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("factsSource: %q should be ec2 or metadata", c.FactsSource))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/errm/ekstrap/pkg/config"
+)
+
+func TestPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+clusterName: from-file
+clusterDNS: 10.100.0.10
+maxPods: 20
+kubeReserved:
+  cpu: 100m
+evictionHard:
+  memory.available: 200Mi
+`)
+	defer os.Remove(path)
+
+	setenv(t, "EKSTRAP_MAX_PODS", "30")
+	setenv(t, "EKSTRAP_CLUSTER_NAME", "from-env")
+	defer os.Unsetenv("EKSTRAP_MAX_PODS")
+	defer os.Unsetenv("EKSTRAP_CLUSTER_NAME")
+
+	cfg, err := load(t, config.Config{PauseImage: "from-base"}, "-config", path, "-cluster-name", "from-flag")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := config.Config{
+		ClusterName:  "from-flag",
+		ClusterDNS:   "10.100.0.10",
+		MaxPods:      30,
+		KubeReserved: config.Reserved{CPU: "100m"},
+		EvictionHard: map[string]string{"memory.available": "200Mi"},
+		PauseImage:   "from-base",
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected config %+v, got %+v", expected, cfg)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	cfg, err := load(t, config.Config{},
+		"-config", filepath.Join(os.TempDir(), "ekstrap-missing-config.yaml"),
+	)
+	if err == nil {
+		t.Errorf("expected an error when an explicit config file is missing, got %+v", cfg)
+	}
+
+	setenv(t, "EKSTRAP_CONFIG", filepath.Join(os.TempDir(), "ekstrap-missing-config.yaml"))
+	defer os.Unsetenv("EKSTRAP_CONFIG")
+	if _, err := load(t, config.Config{}); err == nil {
+		t.Error("expected an error when the config file set with EKSTRAP_CONFIG is missing")
+	}
+	os.Unsetenv("EKSTRAP_CONFIG")
+
+	cfg, err = load(t, config.Config{},
+		"-max-pods", "110",
+		"-kube-reserved-cpu", "250m",
+		"-kube-reserved-memory", "2Gi",
+		"-eviction-hard", "memory.available=500Mi, nodefs.available=5%",
+		"-pause-image", "registry.example.com/pause:3.9",
+		"-pause-image-tag", "3.5",
+		"-pause-image-multi-arch",
+		"-cgroup-driver", "systemd",
+		"-registry-mirrors", "docker.io=https://mirror.example.com, docker.io=https://mirror2.example.com,quay.io=http://10.0.0.1:5000",
+		"-insecure-registries", "registry.example.com:5000, 10.0.0.0/8",
+		"-ekstrap-path", "/opt/bin/ekstrap",
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := config.Config{
+		MaxPods:             110,
+		KubeReserved:        config.Reserved{CPU: "250m", Memory: "2Gi"},
+		EvictionHard:        map[string]string{"memory.available": "500Mi", "nodefs.available": "5%"},
+		PauseImage:          "registry.example.com/pause:3.9",
+		PauseImageTag:       "3.5",
+		PauseImageMultiArch: true,
+		CgroupDriver:        "systemd",
+		RegistryMirrors: map[string][]string{
+			"docker.io": {"https://mirror.example.com", "https://mirror2.example.com"},
+			"quay.io":   {"http://10.0.0.1:5000"},
+		},
+		InsecureRegistries: []string{"registry.example.com:5000", "10.0.0.0/8"},
+		EkstrapPath:        "/opt/bin/ekstrap",
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected config %+v, got %+v", expected, cfg)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		file     string
+		env      map[string]string
+		args     []string
+		expected string
+	}{
+		{
+			desc:     "unknown key in the config file",
+			file:     "maxpods: 10\n",
+			expected: "field maxpods not found",
+		},
+		{
+			desc:     "malformed config file",
+			file:     "maxPods: [\n",
+			expected: "couldn't parse config file",
+		},
+		{
+			desc:     "invalid environment variable",
+			env:      map[string]string{"EKSTRAP_MAX_PODS": "lots"},
+			expected: `invalid value for EKSTRAP_MAX_PODS: "lots" is not a whole number`,
+		},
+		{
+			desc:     "invalid flag",
+			args:     []string{"-eviction-hard", "memory.available"},
+			expected: `invalid value for -eviction-hard: "memory.available" should be in the form signal=threshold`,
+		},
+		{
+			desc:     "invalid boolean",
+			env:      map[string]string{"EKSTRAP_PAUSE_IMAGE_MULTI_ARCH": "yes please"},
+			expected: `invalid value for EKSTRAP_PAUSE_IMAGE_MULTI_ARCH: "yes please" is not true or false`,
+		},
+		{
+			desc:     "unknown exec api version",
+			args:     []string{"-exec-api-version", "v2"},
+			expected: `execAPIVersion: "v2" should be v1alpha1, v1beta1 or v1`,
+		},
+		{
+			desc:     "unknown drift policy",
+			env:      map[string]string{"EKSTRAP_DRIFT_POLICY": "ignore"},
+			expected: `driftPolicy: "ignore" should be warn, refuse or backup`,
+		},
+		{
+			desc:     "unknown cgroup driver",
+			args:     []string{"-cgroup-driver", "cgroupv2"},
+			expected: `cgroupDriver: "cgroupv2" should be cgroupfs or systemd`,
+		},
+		{
+			desc:     "malformed registry mirror",
+			env:      map[string]string{"EKSTRAP_REGISTRY_MIRRORS": "https://mirror.example.com"},
+			expected: `invalid value for EKSTRAP_REGISTRY_MIRRORS: "https://mirror.example.com" should be in the form registry=endpoint`,
+		},
+		{
+			desc:     "unknown facts source",
+			args:     []string{"-cluster-name", "cluster", "-facts-source", "ec2-api"},
+			expected: `factsSource: "ec2-api" should be ec2 or metadata`,
+		},
+		{
+			desc:     "facts from metadata without a cluster name",
+			env:      map[string]string{"EKSTRAP_FACTS_SOURCE": "metadata"},
+			expected: "clusterName: must be set when factsSource is metadata",
+		},
+		{
+			desc: "invalid values",
+			file: `
+clusterName: "-invalid"
+clusterDNS: 10.100.0
+maxPods: -1
+kubeReserved:
+  cpu: 1 core
+  memory: 1GB
+evictionHard:
+  memory.free: 1Mi
+  nodefs.available: ten percent
+pauseImage: "pause 3.1"
+pauseImageTag: ":3.1"
+registryMirrors:
+  "docker.io/library": [https://mirror.example.com]
+  quay.io: [mirror.example.com]
+insecureRegistries: ["https://registry.example.com", "10.0.0.0/33"]
+ekstrapPath: bin/ekstrap
+`,
+			expected: `invalid config:
+  clusterName: "-invalid" is not a valid EKS cluster name
+  clusterDNS: "10.100.0" is not an IP address
+  maxPods: -1 must not be negative
+  kubeReserved.cpu: "1 core" is not a CPU quantity e.g. 100m
+  kubeReserved.memory: "1GB" is not a memory quantity e.g. 1024Mi
+  evictionHard: "memory.free" is not an eviction signal
+  evictionHard.nodefs.available: "ten percent" is not a quantity or percentage
+  pauseImage: "pause 3.1" is not a valid image name
+  pauseImageTag: ":3.1" is not a valid image tag
+  registryMirrors: "docker.io/library" is not a registry host name
+  registryMirrors.quay.io: "mirror.example.com" is not an http(s) URL
+  insecureRegistries: "https://registry.example.com" is not a registry host name or CIDR
+  insecureRegistries: "10.0.0.0/33" is not a registry host name or CIDR
+  ekstrapPath: "bin/ekstrap" is not an absolute path`,
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			args := tC.args
+			if tC.file != "" {
+				path := writeConfig(t, tC.file)
+				defer os.Remove(path)
+				args = append(args, "-config", path)
+			}
+			for key, value := range tC.env {
+				setenv(t, key, value)
+				defer os.Unsetenv(key)
+			}
+			_, err := load(t, config.Config{}, args...)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tC.expected) {
+				t.Errorf("expected error to contain:\n%s\ngot:\n%s", tC.expected, err.Error())
+			}
+		})
+	}
+}
+
+func load(t *testing.T, base config.Config, args ...string) (config.Config, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfgFlags := config.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("unexpected error parsing flags: %v", err)
+	}
+	return cfgFlags.Load(base)
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "config.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return f.Name()
+}
+
+func setenv(t *testing.T, key, value string) {
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
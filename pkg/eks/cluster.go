@@ -17,9 +17,9 @@ limitations under the License.
 package eks
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"time"
 
 	"github.com/errm/ekstrap/pkg/backoff"
 
@@ -36,26 +36,34 @@ var b = backoff.Backoff{Seq: []int{1, 2, 4, 8, 16, 32, 64}}
 // If the cluster doesn't exist, or hasn't yet started it will block until it is ready.
 // If the EKS service is unavalible it will backoff and retry
 // If the cluster is deleting failed, or there are any other errors an error will be returned
-func Cluster(svc eksiface.EKSAPI, name string) (*eks.Cluster, error) {
+// If ctx is done before the cluster is ready, the reason from ctx is returned
+func Cluster(ctx context.Context, svc eksiface.EKSAPI, name string) (*eks.Cluster, error) {
 	input := &eks.DescribeClusterInput{
 		Name: aws.String(name),
 	}
 	tries := 1
 	for {
-		result, err := svc.DescribeCluster(input)
+		result, err := svc.DescribeClusterWithContext(ctx, input)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); ok {
 				switch aerr.Code() {
 				case eks.ErrCodeResourceNotFoundException:
 					sleepFor := b.Duration(tries)
 					log.Printf("The EKS cluster: %s does not (yet) exist, will try again in %s", name, sleepFor)
-					time.Sleep(sleepFor)
+					if err := backoff.Wait(ctx, sleepFor); err != nil {
+						return nil, err
+					}
 					tries++
 					continue
 				case eks.ErrCodeServiceUnavailableException:
 					sleepFor := b.Duration(tries)
 					log.Printf("The EKS service is currentlty unavalible, will try again in %s", sleepFor)
-					time.Sleep(sleepFor)
+					if err := backoff.Wait(ctx, sleepFor); err != nil {
+						return nil, err
+					}
 					tries++
 					continue
 				}
@@ -69,7 +77,9 @@ func Cluster(svc eksiface.EKSAPI, name string) (*eks.Cluster, error) {
 		case eks.ClusterStatusCreating:
 			sleepFor := b.Duration(tries)
 			log.Printf("Waiting for the EKS cluster: %s to start, will try again in %s", name, sleepFor)
-			time.Sleep(sleepFor)
+			if err := backoff.Wait(ctx, sleepFor); err != nil {
+				return nil, err
+			}
 			tries++
 			continue
 		}
@@ -17,12 +17,16 @@ limitations under the License.
 package eks
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/errm/ekstrap/pkg/backoff"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/eks"
 	"github.com/aws/aws-sdk-go/service/eks/eksiface"
 )
@@ -106,7 +110,7 @@ func TestCluster(t *testing.T) {
 			clusters: test.clusters,
 			errs:     test.errors,
 		}
-		cluster, err := Cluster(svc, "cluster-name")
+		cluster, err := Cluster(context.Background(), svc, "cluster-name")
 		if cluster != test.expected {
 			t.Errorf("expected cluster: %v, got %v", test.expected, cluster)
 		}
@@ -122,13 +126,43 @@ func TestCluster(t *testing.T) {
 	}
 }
 
+func TestClusterContext(t *testing.T) {
+	creatingStatus := eks.ClusterStatusCreating
+	creatingCluster := &eks.Cluster{Status: &creatingStatus}
+
+	b = backoff.Backoff{Seq: []int{60}}
+	defer disableBackoff()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	svc := &mockEKS{
+		clusters: []*eks.Cluster{creatingCluster},
+		errs:     []error{nil},
+	}
+	_, err := Cluster(ctx, svc, "cluster-name")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected error: %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	svc = &mockEKS{
+		clusters: []*eks.Cluster{nil},
+		errs:     []error{awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled)},
+	}
+	_, err = Cluster(ctx, svc, "cluster-name")
+	if err != context.Canceled {
+		t.Errorf("expected error: %v, got %v", context.Canceled, err)
+	}
+}
+
 type mockEKS struct {
 	eksiface.EKSAPI
 	clusters []*eks.Cluster
 	errs     []error
 }
 
-func (m *mockEKS) DescribeCluster(input *eks.DescribeClusterInput) (*eks.DescribeClusterOutput, error) {
+func (m *mockEKS) DescribeClusterWithContext(ctx aws.Context, input *eks.DescribeClusterInput, opts ...request.Option) (*eks.DescribeClusterOutput, error) {
 	var cluster *eks.Cluster
 	// Pop first cluster from clusters
 	cluster, m.clusters = m.clusters[0], m.clusters[1:]
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package facts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/errm/ekstrap/pkg/config"
+	"github.com/errm/ekstrap/pkg/node"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/eks"
+)
+
+// Snapshot captures everything that ekstrap discovers about a node and its cluster.
+//
+// A Snapshot can be saved as JSON and later used to render exactly the same
+// config, without any access to AWS or systemd.
+type Snapshot struct {
+	// EkstrapVersion is the version of ekstrap that captured the snapshot
+	EkstrapVersion   string        `json:"ekstrapVersion,omitempty"`
+	CapturedAt       time.Time     `json:"capturedAt"`
+	Instance         *ec2.Instance `json:"instance"`
+	Region           string        `json:"region"`
+	ContainerRuntime string        `json:"containerRuntime"`
+	KubeletVersion   string        `json:"kubeletVersion,omitempty"`
+	Cluster          *eks.Cluster  `json:"cluster"`
+	// Config is the config that was in use when the snapshot was captured
+	Config *config.Config `json:"config,omitempty"`
+}
+
+// New returns a Snapshot of the given node and cluster
+func New(n *node.Node, cluster *eks.Cluster, version string) *Snapshot {
+	var cfg *config.Config
+	if !reflect.DeepEqual(n.Config, config.Config{}) {
+		cfg = &n.Config
+	}
+	return &Snapshot{
+		EkstrapVersion:   version,
+		CapturedAt:       time.Now().UTC(),
+		Instance:         n.Instance,
+		Region:           n.Region,
+		ContainerRuntime: n.ContainerRuntime,
+		KubeletVersion:   n.KubeletVersion,
+		Cluster:          cluster,
+		Config:           cfg,
+	}
+}
+
+// Read reads a Snapshot that was previously saved with Write
+//
+// An error is returned if the snapshot is missing any of the facts that
+// are needed to render config.
+func Read(r io.Reader) (*Snapshot, error) {
+	var s Snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("couldn't parse facts snapshot: %v", err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("invalid facts snapshot: %v", err)
+	}
+	return &s, nil
+}
+
+// Write saves the Snapshot as JSON
+//
+// The AWS SDK types don't omit empty fields, so null values are
+// stripped to keep the snapshot readable.
+func (s *Snapshot) Write(w io.Writer) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(withoutNulls(v))
+}
+
+func withoutNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if value == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = withoutNulls(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = withoutNulls(value)
+		}
+	}
+	return v
+}
+
+// Node returns the node described by the Snapshot
+func (s *Snapshot) Node() *node.Node {
+	n := &node.Node{
+		Instance:         s.Instance,
+		Region:           s.Region,
+		ContainerRuntime: s.ContainerRuntime,
+		KubeletVersion:   s.KubeletVersion,
+	}
+	if s.Config != nil {
+		n.Config = *s.Config
+	}
+	return n
+}
+
+func (s *Snapshot) validate() error {
+	switch {
+	case s.Instance == nil:
+		return errors.New("instance is missing")
+	case s.Instance.InstanceType == nil:
+		return errors.New("instance.InstanceType is missing")
+	case s.Instance.PrivateIpAddress == nil:
+		return errors.New("instance.PrivateIpAddress is missing")
+	case s.Instance.PrivateDnsName == nil:
+		return errors.New("instance.PrivateDnsName is missing")
+	case s.Region == "":
+		return errors.New("region is missing")
+	case s.ContainerRuntime == "":
+		return errors.New("containerRuntime is missing")
+	case s.Cluster == nil:
+		return errors.New("cluster is missing")
+	case s.Cluster.Name == nil:
+		return errors.New("cluster.Name is missing")
+	case s.Cluster.Endpoint == nil:
+		return errors.New("cluster.Endpoint is missing")
+	case s.Cluster.CertificateAuthority == nil || s.Cluster.CertificateAuthority.Data == nil:
+		return errors.New("cluster.CertificateAuthority.Data is missing")
+	}
+	return nil
+}
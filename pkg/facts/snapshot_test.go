@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package facts_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/errm/ekstrap/pkg/config"
+	"github.com/errm/ekstrap/pkg/facts"
+	"github.com/errm/ekstrap/pkg/node"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/eks"
+)
+
+func TestRoundTrip(t *testing.T) {
+	n := &node.Node{
+		Instance: &ec2.Instance{
+			InstanceId:       aws.String("i-1234"),
+			InstanceType:     aws.String("c5.large"),
+			PrivateIpAddress: aws.String("10.6.28.199"),
+			PrivateDnsName:   aws.String("ip-10-6-28-199.us-west-2.compute.internal"),
+			Architecture:     aws.String("x86_64"),
+			Tags: []*ec2.Tag{
+				{Key: aws.String("kubernetes.io/cluster/aws-om-cluster"), Value: aws.String("owned")},
+			},
+		},
+		Region:           "us-west-2",
+		ContainerRuntime: "containerd",
+		KubeletVersion:   "v1.27.3",
+		Config: config.Config{
+			MaxPods: 110,
+		},
+	}
+	c := &eks.Cluster{
+		Name:     aws.String("aws-om-cluster"),
+		Endpoint: aws.String("https://74770F6B05F7A8FB0F02CFB5F7AF530C.yl4.us-west-2.eks.amazonaws.com"),
+		Status:   aws.String(eks.ClusterStatusActive),
+		CertificateAuthority: &eks.Certificate{
+			Data: aws.String("dGhpc2lzdGhlY2VydGRhdGE="),
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := facts.New(n, c, "1.2.3").Write(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	snapshot, err := facts.Read(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if snapshot.EkstrapVersion != "1.2.3" {
+		t.Errorf("expected version 1.2.3, got %s", snapshot.EkstrapVersion)
+	}
+
+	if !reflect.DeepEqual(snapshot.Node(), n) {
+		t.Errorf("expected node %v, got %v", n, snapshot.Node())
+	}
+
+	if !reflect.DeepEqual(snapshot.Cluster, c) {
+		t.Errorf("expected cluster %v, got %v", c, snapshot.Cluster)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		json     string
+		expected string
+	}{
+		{
+			desc:     "invalid json",
+			json:     `{"instance": `,
+			expected: "couldn't parse facts snapshot: unexpected EOF",
+		},
+		{
+			desc:     "no instance",
+			json:     `{"region": "us-west-2"}`,
+			expected: "invalid facts snapshot: instance is missing",
+		},
+		{
+			desc: "no cluster",
+			json: `{
+				"instance": {"InstanceType": "c5.large", "PrivateIpAddress": "10.0.0.1", "PrivateDnsName": "ip-10-0-0-1"},
+				"region": "us-west-2",
+				"containerRuntime": "docker"
+			}`,
+			expected: "invalid facts snapshot: cluster is missing",
+		},
+		{
+			desc: "no certificate",
+			json: `{
+				"instance": {"InstanceType": "c5.large", "PrivateIpAddress": "10.0.0.1", "PrivateDnsName": "ip-10-0-0-1"},
+				"region": "us-west-2",
+				"containerRuntime": "docker",
+				"cluster": {"Name": "cluster", "Endpoint": "https://example.com"}
+			}`,
+			expected: "invalid facts snapshot: cluster.CertificateAuthority.Data is missing",
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := facts.Read(strings.NewReader(tC.json))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if err.Error() != tC.expected {
+				t.Errorf("expected error %q, got %q", tC.expected, err.Error())
+			}
+		})
+	}
+}
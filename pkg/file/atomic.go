@@ -18,58 +18,115 @@ package file
 
 import (
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"syscall"
-
-	"github.com/dchest/safefile"
 )
 
 // Atomic exposes an interface to atomicly write config files to the filesystem
-type Atomic struct{}
+//
+// If DryRun is set the changes that would be made are logged, but nothing is written.
+// If Root is set it is prepended to every path, so files can be written to
+// a staging directory rather than to the root filesystem.
+// Context is the number of unchanged lines logged around each change.
+// Manifest is the path of a manifest of the files that are managed, used by Prune,
+// and with Drift to decide what to do with files that have been edited since they were written.
+type Atomic struct {
+	Root     string
+	DryRun   bool
+	Context  int
+	Manifest string
+	Drift    DriftPolicy
+}
 
-// Sync atomicly writes data to a file at the given path with the given permissions
+// Sync atomicly writes data to a file at the given path with the given permissions and ownership
 //
 // If the parent directory does not exit it is created
-// If the file already exists and diff returns 0 then this command is a noopp
-// Requires the diff utility to be present on the system, since it is specified in POSIX we assume it is
-func (a Atomic) Sync(data io.Reader, path string, perm os.FileMode) error {
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0710); err != nil {
-		return err
+// If the file already exists with the same contents then they are left alone,
+// but its permissions and ownership are corrected if they have drifted
+// It returns true if the file's contents were (or with DryRun, would be) changed
+func (a Atomic) Sync(data io.Reader, path string, meta Metadata) (bool, error) {
+	if a.DryRun {
+		return a.dryRun(data, path, meta.withDefaults())
 	}
-	f, err := safefile.Create(path, perm)
+	t := Transaction{Root: a.Root, Context: a.Context, Manifest: a.Manifest, Drift: a.Drift}
+	changed, err := t.Sync(data, path, meta)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer f.Close()
-	if _, err = io.Copy(f, data); err != nil {
-		return err
+	return changed, t.Commit()
+}
+
+// Prune removes any files in the Manifest that aren't in keep, and updates
+// the Manifest to list the files in keep, it does nothing if there is no Manifest.
+//
+// It returns true if any files were (or with DryRun, would be) removed.
+func (a Atomic) Prune(keep []string) (bool, error) {
+	if a.Manifest == "" {
+		return false, nil
 	}
-	if output, needsWrite := diff(path, f.Name()); needsWrite {
-		log.Printf("File: %s will be updated:", path)
-		log.Printf("%s", output)
-		return f.Commit()
+	if a.DryRun {
+		orphans, err := orphans(a.Root, a.Manifest, keep)
+		for _, orphan := range orphans {
+			log.Printf("File: %s is no longer managed by ekstrap, it would be removed", rooted(a.Root, orphan))
+		}
+		return len(orphans) > 0, err
 	}
-	return nil
+	t := Transaction{Root: a.Root, Manifest: a.Manifest}
+	changed, err := t.Prune(keep)
+	if err != nil {
+		return false, err
+	}
+	return changed, t.Commit()
 }
 
-func diff(path, new string) ([]byte, bool) {
-	old := path
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		old = "/dev/null"
+func (a Atomic) dryRun(data io.Reader, name string, meta Metadata) (bool, error) {
+	path := rooted(a.Root, name)
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return false, err
 	}
-	diff := exec.Command("diff", old, new)
-	if output, err := diff.Output(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				if status.ExitStatus() == 1 {
-					return output, true
-				}
-			}
+	output, needsWrite, err := compare(path, contents, a.Context, meta.Redact)
+	if err != nil {
+		return false, err
+	}
+	if needsWrite {
+		if err := a.reportEdited(name, path); err != nil {
+			return false, err
+		}
+		log.Printf("File: %s would be updated:", path)
+		log.Printf("%s", output)
+		return true, nil
+	}
+	if info, err := os.Stat(path); err == nil {
+		if current := metadataOf(info); meta.drifted(current) {
+			log.Printf("File: %s would have its permissions and ownership changed from %s to %s", path, current, meta)
 		}
 	}
-	return []byte{}, false
+	return false, nil
+}
+
+// reportEdited logs what the drift policy would do if the file at path has
+// been edited since it was written
+func (a Atomic) reportEdited(name, path string) error {
+	if a.Manifest == "" {
+		return nil
+	}
+	m, err := readManifest(rooted(a.Root, a.Manifest))
+	if err != nil {
+		return err
+	}
+	edited, err := m.edited(name, path)
+	if err != nil || !edited {
+		return err
+	}
+	switch a.Drift {
+	case DriftRefuse:
+		log.Printf("File: %s has been edited since ekstrap wrote it, ekstrap would refuse to overwrite it as the drift policy is %s", path, DriftRefuse)
+	case DriftBackup:
+		log.Printf("File: %s has been edited since ekstrap wrote it, it would be backed up before it is overwritten", path)
+	default:
+		log.Printf("File: %s has been edited since ekstrap wrote it, the edits would be overwritten", path)
+	}
+	return nil
 }
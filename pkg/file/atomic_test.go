@@ -22,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -37,7 +38,7 @@ func TestWritingToNonExistantFile(t *testing.T) {
 
 	filename := filepath.Join(dir, "filename")
 
-	err = file.Sync(strings.NewReader("Hello World"), filename, 0640)
+	_, err = file.Sync(strings.NewReader("Hello World"), filename, pkg.Metadata{Mode: 0640})
 	check(t, err)
 
 	contents, err := ioutil.ReadFile(filename)
@@ -59,7 +60,7 @@ func TestPermissions(t *testing.T) {
 
 	for _, perm := range perms {
 		filename := filepath.Join(dir, fmt.Sprintf("filename-%s", perm))
-		err = file.Sync(strings.NewReader("string"), filename, perm)
+		_, err = file.Sync(strings.NewReader("string"), filename, pkg.Metadata{Mode: perm})
 		check(t, err)
 		info, err := os.Stat(filename)
 		check(t, err)
@@ -80,8 +81,11 @@ func TestOverwrite(t *testing.T) {
 	err = ioutil.WriteFile(filename, []byte("Old contents"), 0644)
 	check(t, err)
 
-	err = file.Sync(strings.NewReader("New contents"), filename, 0644)
+	changed, err := file.Sync(strings.NewReader("New contents"), filename, pkg.Metadata{Mode: 0644})
 	check(t, err)
+	if !changed {
+		t.Errorf("Expected the file to be reported as changed")
+	}
 
 	contents, err := ioutil.ReadFile(filename)
 	check(t, err)
@@ -104,8 +108,11 @@ func TestNoOppOverwrite(t *testing.T) {
 	mtime := info.ModTime()
 	time.Sleep(10 * time.Millisecond)
 
-	err = file.Sync(strings.NewReader("contents"), filename, 0644)
+	changed, err := file.Sync(strings.NewReader("contents"), filename, pkg.Metadata{Mode: 0644})
 	check(t, err)
+	if changed {
+		t.Errorf("Expected the file not to be reported as changed")
+	}
 
 	info, err = os.Stat(filename)
 	check(t, err)
@@ -114,6 +121,117 @@ func TestNoOppOverwrite(t *testing.T) {
 	}
 }
 
+func TestPermissionDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	filename := filepath.Join(dir, "filename")
+	err = ioutil.WriteFile(filename, []byte("contents"), 0600)
+	check(t, err)
+	if os.Geteuid() == 0 {
+		check(t, os.Chown(filename, 1000, 1000))
+	}
+
+	// A dry run doesn't correct anything
+	dryRun := &pkg.Atomic{DryRun: true}
+	changed, err := dryRun.Sync(strings.NewReader("contents"), filename, pkg.Metadata{Mode: 0644})
+	check(t, err)
+	if changed {
+		t.Errorf("Expected the permissions change not to be reported as a change to the contents")
+	}
+	info, err := os.Stat(filename)
+	check(t, err)
+	if info.Mode() != 0600 {
+		t.Errorf("Expecting mode: %s, got %s", os.FileMode(0600), info.Mode())
+	}
+
+	changed, err = file.Sync(strings.NewReader("contents"), filename, pkg.Metadata{Mode: 0644})
+	check(t, err)
+	if changed {
+		t.Errorf("Expected the permissions change not to be reported as a change to the contents")
+	}
+	info, err = os.Stat(filename)
+	check(t, err)
+	if info.Mode() != 0644 {
+		t.Errorf("Expecting mode: %s, got %s", os.FileMode(0644), info.Mode())
+	}
+	if stat := info.Sys().(*syscall.Stat_t); os.Geteuid() == 0 && (stat.Uid != 0 || stat.Gid != 0) {
+		t.Errorf("Expecting the file to be owned by root, got %d:%d", stat.Uid, stat.Gid)
+	}
+}
+
+func TestDirMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	staging := &pkg.Atomic{Root: dir}
+	_, err = staging.Sync(strings.NewReader("Hello World"), "/default/filename", pkg.Metadata{})
+	check(t, err)
+	_, err = staging.Sync(strings.NewReader("Hello World"), "/custom/filename", pkg.Metadata{Mode: 0644, DirMode: 0755})
+	check(t, err)
+
+	expected := map[string]os.FileMode{
+		"default":          os.ModeDir | 0710,
+		"default/filename": 0640,
+		"custom":           os.ModeDir | 0755,
+		"custom/filename":  0644,
+	}
+	for path, mode := range expected {
+		info, err := os.Stat(filepath.Join(dir, path))
+		check(t, err)
+		if info.Mode() != mode {
+			t.Errorf("Expecting mode: %s for %s, got %s", mode, path, info.Mode())
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	dryRun := &pkg.Atomic{DryRun: true}
+
+	filename := filepath.Join(dir, "filename")
+	err = ioutil.WriteFile(filename, []byte("Old contents"), 0644)
+	check(t, err)
+
+	_, err = dryRun.Sync(strings.NewReader("New contents"), filename, pkg.Metadata{Mode: 0644})
+	check(t, err)
+
+	contents, err := ioutil.ReadFile(filename)
+	check(t, err)
+	if string(contents) != "Old contents" {
+		t.Errorf("File should not have been rewritten, contents: %s", contents)
+	}
+
+	missing := filepath.Join(dir, "subdir", "filename")
+	_, err = dryRun.Sync(strings.NewReader("New contents"), missing, pkg.Metadata{Mode: 0644})
+	check(t, err)
+
+	if _, err := os.Stat(filepath.Dir(missing)); !os.IsNotExist(err) {
+		t.Errorf("Directory should not have been created")
+	}
+}
+
+func TestRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	staging := &pkg.Atomic{Root: dir}
+	_, err = staging.Sync(strings.NewReader("Hello World"), "/etc/kubernetes/filename", pkg.Metadata{Mode: 0640})
+	check(t, err)
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "etc", "kubernetes", "filename"))
+	check(t, err)
+	if string(contents) != "Hello World" {
+		t.Errorf("Unexpected file contents: %s", contents)
+	}
+}
+
 func check(t *testing.T, err error) {
 	if err != nil {
 		t.Errorf("Unexpected error %s", err)
@@ -0,0 +1,248 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultContext is the number of unchanged lines usually shown around each change in a diff
+const DefaultContext = 3
+
+// compare compares the contents of the file at path with data, it returns
+// a description of the changes, and true if there are any.
+//
+// The changes are described with a unified diff, with anything that redact
+// says should be hidden left out.
+// A missing file is compared as if it were empty, but is always a change.
+func compare(path string, data []byte, context int, redact Redaction) (string, bool, error) {
+	oldName := path
+	old, err := ioutil.ReadFile(path)
+	exists := err == nil
+	if os.IsNotExist(err) {
+		oldName = "/dev/null"
+	} else if err != nil {
+		return "", false, err
+	} else if bytes.Equal(old, data) {
+		return "", false, nil
+	}
+	if !redact.enabled() {
+		return unifiedDiff(oldName, old, path, data, context, redact), true, nil
+	}
+	sums := fmt.Sprintf("sha256 %s -> %s\n", checksum(old, exists), checksum(data, true))
+	if redact.Sensitive {
+		return sums + "(the changes are not shown as the file is sensitive)\n", true, nil
+	}
+	return sums + unifiedDiff(oldName, old, path, data, context, redact), true, nil
+}
+
+// unifiedDiff returns the differences between old and new in the unified
+// format, with context unchanged lines around each change.
+//
+// If either isn't text, we just say that they differ.
+func unifiedDiff(oldName string, old []byte, newName string, new []byte, context int, redact Redaction) string {
+	if isBinary(old) || isBinary(new) {
+		return fmt.Sprintf("Binary files %s and %s differ\n", oldName, newName)
+	}
+	if context < 0 {
+		context = 0
+	}
+	oldLines, newLines := splitLines(old), splitLines(new)
+	ops := edits(oldLines, newLines)
+	if redact.enabled() {
+		oldLines, newLines = redact.lines(oldLines), redact.lines(newLines)
+		for i, op := range ops {
+			if op.kind == '+' {
+				ops[i].line = newLines[op.newIndex]
+			} else {
+				ops[i].line = oldLines[op.oldIndex]
+			}
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			// Changes that are close together share a hunk
+			if next < len(ops) && next-end <= 2*context {
+				end = next
+				continue
+			}
+			end += context
+			if end > len(ops) {
+				end = len(ops)
+			}
+			break
+		}
+		writeHunk(&out, ops[start:end])
+		i = end
+	}
+	return out.String()
+}
+
+func writeHunk(out *strings.Builder, ops []edit) {
+	var oldLines, newLines int
+	for _, op := range ops {
+		if op.kind != '+' {
+			oldLines++
+		}
+		if op.kind != '-' {
+			newLines++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(ops[0].oldIndex, oldLines), hunkRange(ops[0].newIndex, newLines))
+	for _, op := range ops {
+		out.WriteByte(op.kind)
+		out.WriteString(strings.TrimSuffix(op.line, "\n"))
+		out.WriteByte('\n')
+		if !strings.HasSuffix(op.line, "\n") {
+			out.WriteString("\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the range of lines in a hunk, when it is empty the
+// range starts at the line before it
+func hunkRange(index, lines int) string {
+	switch lines {
+	case 0:
+		return fmt.Sprintf("%d,0", index)
+	case 1:
+		return fmt.Sprintf("%d", index+1)
+	default:
+		return fmt.Sprintf("%d,%d", index+1, lines)
+	}
+}
+
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data)
+}
+
+// splitLines splits data into lines, each keeping its newline (if it has one)
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// edit is a line that is unchanged (' '), deleted ('-') or inserted ('+'),
+// with the index of that line, or where it would be, in the old and new files.
+type edit struct {
+	kind     byte
+	line     string
+	oldIndex int
+	newIndex int
+}
+
+// edits returns the shortest list of edits that turns a into b, using
+// Myers' algorithm (http://www.xmailserver.org/diff2.pdf).
+func edits(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	// v holds the furthest x reached on each diagonal k, at v[k+offset]
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace holds the part of v that each step started from, so we can backtrack
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	var reversed []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		prev := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev(k-1) < prev(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, edit{kind: ' ', line: a[x], oldIndex: x, newIndex: y})
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, edit{kind: '+', line: b[prevY], oldIndex: prevX, newIndex: prevY})
+			} else {
+				reversed = append(reversed, edit{kind: '-', line: a[prevX], oldIndex: prevX, newIndex: prevY})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	result := make([]edit, len(reversed))
+	for i, e := range reversed {
+		result[len(reversed)-1-i] = e
+	}
+	return result
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		old      string
+		new      string
+		context  int
+		expected string
+	}{
+		{
+			desc:    "changes far apart are in separate hunks",
+			old:     "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n",
+			new:     "a\nb\nc\nD\ne\nf\ng\nh\ni\nJ\n",
+			context: 1,
+			expected: `--- old
++++ new
+@@ -3,3 +3,3 @@
+ c
+-d
++D
+ e
+@@ -9,2 +9,2 @@
+ i
+-j
++J
+`,
+		},
+		{
+			desc:    "changes close together share a hunk",
+			old:     "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n",
+			new:     "a\nb\nc\nD\ne\nf\ng\nh\ni\nJ\n",
+			context: 3,
+			expected: `--- old
++++ new
+@@ -1,10 +1,10 @@
+ a
+ b
+ c
+-d
++D
+ e
+ f
+ g
+ h
+ i
+-j
++J
+`,
+		},
+		{
+			desc:    "no context",
+			old:     "a\nb\nc\n",
+			new:     "a\nc\nd\n",
+			context: 0,
+			expected: `--- old
++++ new
+@@ -2 +1,0 @@
+-b
+@@ -3,0 +3 @@
++d
+`,
+		},
+		{
+			desc:    "new file",
+			old:     "",
+			new:     "one\ntwo\n",
+			context: 3,
+			expected: `--- old
++++ new
+@@ -0,0 +1,2 @@
++one
++two
+`,
+		},
+		{
+			desc:    "missing newline",
+			old:     "one\ntwo",
+			new:     "one\ntwo\n",
+			context: 3,
+			expected: `--- old
++++ new
+@@ -1,2 +1,2 @@
+ one
+-two
+\ No newline at end of file
++two
+`,
+		},
+		{
+			desc:     "binary",
+			old:      "one\n",
+			new:      "\x00\x01\x02",
+			context:  3,
+			expected: "Binary files old and new differ\n",
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			actual := unifiedDiff("old", []byte(tC.old), "new", []byte(tC.new), tC.context, Redaction{})
+			if actual != tC.expected {
+				t.Errorf("unexpected diff, expected:\n%s\ngot:\n%s", tC.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "existing")
+	if err := ioutil.WriteFile(path, []byte("contents\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, changed, err := compare(path, []byte("contents\n"), 3, Redaction{}); changed || err != nil {
+		t.Errorf("expected identical contents not to be a change, got %t %v", changed, err)
+	}
+
+	missing := filepath.Join(dir, "missing")
+	output, changed, err := compare(missing, []byte{}, 3, Redaction{})
+	if !changed || err != nil {
+		t.Errorf("expected creating an empty file to be a change, got %t %v", changed, err)
+	}
+	if expected := "--- /dev/null\n+++ " + missing + "\n"; output != expected {
+		t.Errorf("unexpected diff, expected:\n%s\ngot:\n%s", expected, output)
+	}
+
+	// Reading a directory fails, rather than looking like there is no change
+	if _, _, err := compare(dir, []byte("contents\n"), 3, Redaction{}); err == nil {
+		t.Errorf("expected an error comparing a directory")
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := `token: abc123
+name: "node"
+-----BEGIN CERTIFICATE-----
+b2xkY2VydA==
+-----END CERTIFICATE-----
+`
+	new := `token: xyz789
+name: "node"
+-----BEGIN CERTIFICATE-----
+bmV3Y2VydA==
+-----END CERTIFICATE-----
+`
+	path := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(path, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sums := "sha256 3e87db5d08f33c1cd894bbfb2f4c2142216fc4cbddbf4dd434fc84c051736b1d -> f29d13e3fba5cc5b66b104a3f73ebf41abee169d2dd810bff976577045d8e44b\n"
+
+	testCases := []struct {
+		desc     string
+		redact   Redaction
+		expected string
+	}{
+		{
+			desc:   "keys and PEM blocks",
+			redact: Redaction{Keys: []string{"token"}, PEM: true},
+			expected: sums + `--- ` + path + `
++++ ` + path + `
+@@ -1,5 +1,5 @@
+-token: <redacted>
++token: <redacted>
+ name: "node"
+ -----BEGIN CERTIFICATE-----
+-<redacted>
++<redacted>
+ -----END CERTIFICATE-----
+`,
+		},
+		{
+			desc:     "sensitive",
+			redact:   Redaction{Sensitive: true},
+			expected: sums + "(the changes are not shown as the file is sensitive)\n",
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			output, changed, err := compare(path, []byte(new), 3, tC.redact)
+			if !changed || err != nil {
+				t.Errorf("expected a change, got %t %v", changed, err)
+			}
+			if output != tC.expected {
+				t.Errorf("unexpected output, expected:\n%s\ngot:\n%s", tC.expected, output)
+			}
+		})
+	}
+}
+
+func TestRedactKeys(t *testing.T) {
+	lines := []string{
+		"certificate-authority-data: c2VjcmV0\n",
+		"Environment='TOKEN=secret'\n",
+		`{"token": "secret"}` + "\n",
+		"Environment='KUBELET_TOKEN=secret'\n",
+		"Password: secret\n",
+		"tokens: not-redacted\n",
+		"my-token: not-redacted",
+	}
+	expected := []string{
+		"certificate-authority-data: <redacted>\n",
+		"Environment='TOKEN=<redacted>\n",
+		`{"token": <redacted>` + "\n",
+		"Environment='KUBELET_TOKEN=<redacted>\n",
+		"Password: <redacted>\n",
+		"tokens: not-redacted\n",
+		"my-token: not-redacted",
+	}
+	// Keys are matched whatever their case
+	actual := Redaction{Keys: []string{"certificate-authority-data", "token", "password"}}.lines(lines)
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], actual[i])
+		}
+	}
+}
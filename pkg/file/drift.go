@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DriftPolicy is what to do with a file that has been edited since it was
+// written, and recorded in the manifest, when it is going to be overwritten
+type DriftPolicy string
+
+// The drift policies, the zero value behaves like DriftWarn
+const (
+	// DriftWarn logs that the edits will be overwritten
+	DriftWarn DriftPolicy = "warn"
+	// DriftRefuse refuses to overwrite the file, so nothing is written
+	DriftRefuse DriftPolicy = "refuse"
+	// DriftBackup copies the file into the backups directory next to the manifest before it is overwritten
+	DriftBackup DriftPolicy = "backup"
+)
+
+// edited returns true if the file at path (name before the root was
+// prepended) has been edited since its hash was recorded in the manifest.
+//
+// Files that aren't in the manifest, or no longer exist, haven't been edited.
+func (m manifest) edited(name, path string) (bool, error) {
+	for _, f := range m.Files {
+		if f.Path != name {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return checksum(data, true) != f.SHA256, nil
+	}
+	return false, nil
+}
+
+// backupPath returns where a copy of the file name is kept when it is backed up at time t
+func backupPath(root, manifest, name string, t time.Time) string {
+	dir := filepath.Join(filepath.Dir(rooted(root, manifest)), "backups", t.UTC().Format("20060102T150405Z"))
+	return filepath.Join(dir, name)
+}
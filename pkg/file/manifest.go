@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// manifestMetadata is the metadata the manifest itself is written with
+var manifestMetadata = Metadata{Mode: 0644, DirMode: 0755}
+
+// manifest records each of the files that we manage, with a hash of the
+// contents we wrote, so that we can remove them once they are no longer rendered
+type manifest struct {
+	Files []managedFile `json:"files"`
+}
+
+type managedFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+func readManifest(path string) (manifest, error) {
+	var m manifest
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("couldn't parse the manifest %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// orphans returns the paths of the files listed in the manifest at path that
+// aren't in keep, and so should be removed.
+//
+// Files that have been changed since we wrote them are left alone.
+func orphans(root, path string, keep []string) ([]string, error) {
+	m, err := readManifest(rooted(root, path))
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]bool, len(keep))
+	for _, k := range keep {
+		kept[k] = true
+	}
+	var orphans []string
+	for _, f := range m.Files {
+		if kept[f.Path] {
+			continue
+		}
+		orphan := rooted(root, f.Path)
+		data, err := ioutil.ReadFile(orphan)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if checksum(data, true) != f.SHA256 {
+			log.Printf("File: %s is no longer managed by ekstrap, but it has been changed since it was written, so it will be left alone", orphan)
+			continue
+		}
+		orphans = append(orphans, f.Path)
+	}
+	return orphans, nil
+}
+
+// newManifest returns a manifest of the files in keep, with their current contents
+func newManifest(root string, keep []string) ([]byte, error) {
+	var m manifest
+	paths := append([]string(nil), keep...)
+	sort.Strings(paths)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(rooted(root, path))
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, managedFile{Path: path, SHA256: checksum(data, true)})
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func rooted(root, path string) string {
+	if root == "" {
+		return path
+	}
+	return filepath.Join(root, path)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Metadata describes the permissions and ownership that a file should have
+type Metadata struct {
+	Mode os.FileMode
+	UID  int
+	GID  int
+	// DirMode is the mode that any missing parent directories are created with
+	DirMode os.FileMode
+	// Redact is what is hidden when the changes to the file are logged
+	Redact Redaction
+}
+
+// DefaultMetadata is used for files that don't have metadata of their own,
+// and for a Mode or DirMode that is left unset.
+var DefaultMetadata = Metadata{Mode: 0640, DirMode: 0710}
+
+func (m Metadata) String() string {
+	return fmt.Sprintf("%04o %d:%d", m.Mode.Perm(), m.UID, m.GID)
+}
+
+func (m Metadata) withDefaults() Metadata {
+	if m.Mode == 0 {
+		m.Mode = DefaultMetadata.Mode
+	}
+	if m.DirMode == 0 {
+		m.DirMode = DefaultMetadata.DirMode
+	}
+	return m
+}
+
+// metadataOf returns the Metadata of an existing file
+func metadataOf(info os.FileInfo) Metadata {
+	m := Metadata{Mode: info.Mode().Perm()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		m.UID, m.GID = int(stat.Uid), int(stat.Gid)
+	}
+	return m
+}
+
+// drifted returns true if the mode or ownership of the existing file doesn't match m.
+//
+// Ownership is only considered when running as root, as nobody else can change it.
+func (m Metadata) drifted(current Metadata) bool {
+	if current.Mode != m.Mode.Perm() {
+		return true
+	}
+	return os.Geteuid() == 0 && (current.UID != m.UID || current.GID != m.GID)
+}
+
+// correct changes the mode and ownership of the file at path to match m
+func (m Metadata) correct(path string) error {
+	if err := os.Chmod(path, m.Mode.Perm()); err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Chown(path, m.UID, m.GID)
+}
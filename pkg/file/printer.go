@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Printer writes files to Out rather than to the filesystem
+//
+// Each file is written as a separate document, preceded by a header
+// with the path and permissions it would have been written with.
+type Printer struct {
+	Out io.Writer
+}
+
+// Sync writes data to Out, with a header describing the path, permissions and ownership
+//
+// Every file is printed, so it always reports a change.
+func (p Printer) Sync(data io.Reader, path string, meta Metadata) (bool, error) {
+	var buff bytes.Buffer
+	if _, err := buff.ReadFrom(data); err != nil {
+		return false, err
+	}
+	if buff.Len() > 0 && buff.Bytes()[buff.Len()-1] != '\n' {
+		buff.WriteByte('\n')
+	}
+	if _, err := fmt.Fprintf(p.Out, "---\n# %s (%s)\n", path, meta.withDefaults()); err != nil {
+		return false, err
+	}
+	_, err := buff.WriteTo(p.Out)
+	return err == nil, err
+}
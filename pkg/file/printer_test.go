@@ -0,0 +1,46 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	pkg "github.com/errm/ekstrap/pkg/file"
+)
+
+func TestPrinter(t *testing.T) {
+	var out bytes.Buffer
+	printer := pkg.Printer{Out: &out}
+
+	_, err := printer.Sync(strings.NewReader("first\n"), "/etc/first", pkg.Metadata{Mode: 0640})
+	check(t, err)
+	_, err = printer.Sync(strings.NewReader("[Service]"), "/etc/second.conf", pkg.Metadata{Mode: 0644, UID: 1000, GID: 100})
+	check(t, err)
+
+	expected := `---
+# /etc/first (0640 0:0)
+first
+---
+# /etc/second.conf (0644 1000:100)
+[Service]
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
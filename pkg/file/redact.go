@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const redacted = "<redacted>"
+
+// Redaction describes what is hidden when the changes to a file are logged
+//
+// When anything is redacted, the sha256 of the old and new contents is
+// logged as well, so it is still possible to tell what changed.
+type Redaction struct {
+	// Sensitive hides the changes to the file completely
+	Sensitive bool
+	// Keys hides the value of any key with one of these names, ignoring case, or
+	// that ends in _ and one of them e.g. token: abc, TOKEN=abc or KUBELET_TOKEN=abc
+	Keys []string
+	// PEM hides the contents of PEM blocks e.g. certificates and private keys
+	PEM bool
+}
+
+func (r Redaction) enabled() bool {
+	return r.Sensitive || r.PEM || len(r.Keys) > 0
+}
+
+// lines returns lines with anything that should be hidden redacted
+func (r Redaction) lines(lines []string) []string {
+	var keys []*regexp.Regexp
+	for _, key := range r.Keys {
+		keys = append(keys, regexp.MustCompile(`(?i)((?:^|[^a-z0-9-])["']?`+regexp.QuoteMeta(key)+`["']?\s*[:=]\s*)\S.*`))
+	}
+	result := make([]string, len(lines))
+	inPEM := false
+	for i, line := range lines {
+		text := strings.TrimSuffix(line, "\n")
+		newline := line[len(text):]
+		switch {
+		case r.PEM && strings.HasPrefix(strings.TrimSpace(text), "-----BEGIN "):
+			inPEM = true
+		case r.PEM && strings.HasPrefix(strings.TrimSpace(text), "-----END "):
+			inPEM = false
+		case inPEM:
+			text = redacted
+		default:
+			for _, key := range keys {
+				text = key.ReplaceAllString(text, "${1}"+redacted)
+			}
+		}
+		result[i] = text + newline
+	}
+	return result
+}
+
+// checksum describes contents for the log, a missing file has no checksum
+func checksum(contents []byte, exists bool) string {
+	if !exists {
+		return "none"
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(contents))
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"time"
+)
+
+// Tar writes files into a tar archive rather than to the filesystem
+//
+// Entries are given a fixed modification time, so rendering the same
+// config twice produces an identical archive.
+// Close must be called once all the files have been written.
+type Tar struct {
+	w *tar.Writer
+}
+
+// NewTar returns a Tar that writes an archive to w
+func NewTar(w io.Writer) *Tar {
+	return &Tar{w: tar.NewWriter(w)}
+}
+
+// Sync adds data to the archive with the given path, permissions and ownership
+//
+// Every file is added, so it always reports a change.
+func (t *Tar) Sync(data io.Reader, path string, meta Metadata) (bool, error) {
+	meta = meta.withDefaults()
+	var buff bytes.Buffer
+	if _, err := buff.ReadFrom(data); err != nil {
+		return false, err
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimPrefix(path, "/"),
+		Mode:     int64(meta.Mode.Perm()),
+		Size:     int64(buff.Len()),
+		ModTime:  time.Unix(0, 0),
+		Uid:      meta.UID,
+		Gid:      meta.GID,
+		Format:   tar.FormatPAX,
+	}
+	if meta.UID == 0 {
+		header.Uname = "root"
+	}
+	if meta.GID == 0 {
+		header.Gname = "root"
+	}
+	if err := t.w.WriteHeader(header); err != nil {
+		return false, err
+	}
+	_, err := buff.WriteTo(t.w)
+	return err == nil, err
+}
+
+// Close finishes writing the archive
+func (t *Tar) Close() error {
+	return t.w.Close()
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	pkg "github.com/errm/ekstrap/pkg/file"
+)
+
+func TestTar(t *testing.T) {
+	var out bytes.Buffer
+	archive := pkg.NewTar(&out)
+
+	_, err := archive.Sync(strings.NewReader("first"), "/etc/first", pkg.Metadata{Mode: 0640})
+	check(t, err)
+	_, err = archive.Sync(strings.NewReader("second"), "/var/lib/second", pkg.Metadata{Mode: 0644, UID: 1000, GID: 1000})
+	check(t, err)
+	check(t, archive.Close())
+
+	expected := []struct {
+		name     string
+		mode     os.FileMode
+		owner    int
+		contents string
+	}{
+		{name: "etc/first", mode: 0640, owner: 0, contents: "first"},
+		{name: "var/lib/second", mode: 0644, owner: 1000, contents: "second"},
+	}
+
+	r := tar.NewReader(&out)
+	for _, e := range expected {
+		header, err := r.Next()
+		check(t, err)
+		if header.Name != e.name {
+			t.Errorf("Expected entry %s, got %s", e.name, header.Name)
+		}
+		if os.FileMode(header.Mode) != e.mode {
+			t.Errorf("Expected mode %s for %s, got %s", e.mode, e.name, os.FileMode(header.Mode))
+		}
+		if header.Uid != e.owner || header.Gid != e.owner {
+			t.Errorf("Expected %s to be owned by %d:%d, got %d:%d", e.name, e.owner, e.owner, header.Uid, header.Gid)
+		}
+		contents, err := ioutil.ReadAll(r)
+		check(t, err)
+		if string(contents) != e.contents {
+			t.Errorf("Unexpected contents for %s: %s", e.name, contents)
+		}
+	}
+}
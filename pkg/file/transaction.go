@@ -0,0 +1,512 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/dchest/safefile"
+)
+
+// Transaction stages config files, so that they can be written together with Commit
+//
+// Once committed, the files can be restored to how they were before with Rollback.
+// If Root is set it is prepended to every path, as with Atomic.
+type Transaction struct {
+	Root string
+	// Context is the number of unchanged lines logged around each change
+	Context int
+	// Manifest is the path of a manifest of the files that are managed, used by
+	// Prune, and to tell if a file has been edited since it was written
+	Manifest string
+	// Drift is what to do with files that have been edited since they were written
+	Drift DriftPolicy
+	// Generation is the path of a directory where the managed files are copied
+	// to before a commit changes any of them, so the previous generation of
+	// config is kept even once the transaction is over
+	Generation string
+
+	manifest  *manifest
+	staged    []*staged
+	previous  []previous
+	createdAt []string
+
+	pruning bool
+	keep    []string
+	orphans []string
+}
+
+// staged is a file that has been written to a temporary file alongside its destination
+type staged struct {
+	file    *safefile.File
+	name    string
+	path    string
+	meta    Metadata
+	changed bool
+	backup  bool
+}
+
+// previous records how a file was before the transaction was committed
+type previous struct {
+	path    string
+	existed bool
+	data    []byte
+	meta    Metadata
+}
+
+// Sync stages data to be written to a file at the given path, with the given
+// permissions and ownership, when the transaction is committed.
+//
+// It returns true if committing will change the file's contents. If only its
+// permissions or ownership have drifted they are corrected by Commit, but that
+// isn't reported as a change, as nothing needs to be restarted for it.
+// Any missing parent directories are created straight away.
+func (t *Transaction) Sync(data io.Reader, name string, meta Metadata) (bool, error) {
+	meta = meta.withDefaults()
+	path := rooted(t.Root, name)
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return false, err
+	}
+	output, changed, err := compare(path, contents, t.Context, meta.Redact)
+	if err != nil {
+		return false, err
+	}
+	backup := false
+	if changed {
+		if backup, err = t.checkEdited(name, path); err != nil {
+			return false, err
+		}
+	}
+	if err := t.mkdirAll(filepath.Dir(path), meta.DirMode); err != nil {
+		return false, err
+	}
+	f, err := safefile.Create(path, meta.Mode)
+	if err != nil {
+		return false, err
+	}
+	if _, err = f.Write(contents); err != nil {
+		f.Close()
+		return false, err
+	}
+	if changed {
+		log.Printf("File: %s will be updated:", path)
+		log.Printf("%s", output)
+	}
+	t.staged = append(t.staged, &staged{file: f, name: name, path: path, meta: meta, changed: changed, backup: backup})
+	return changed, nil
+}
+
+// checkEdited applies the drift policy if the file at path has been edited
+// since it was written, it returns true if the file should be backed up.
+func (t *Transaction) checkEdited(name, path string) (bool, error) {
+	if t.Manifest == "" {
+		return false, nil
+	}
+	if t.manifest == nil {
+		m, err := readManifest(rooted(t.Root, t.Manifest))
+		if err != nil {
+			return false, err
+		}
+		t.manifest = &m
+	}
+	edited, err := t.manifest.edited(name, path)
+	if err != nil || !edited {
+		return false, err
+	}
+	switch t.Drift {
+	case DriftRefuse:
+		return false, fmt.Errorf("%s has been edited since ekstrap wrote it, refusing to overwrite it as the drift policy is %s", path, DriftRefuse)
+	case DriftBackup:
+		log.Printf("File: %s has been edited since ekstrap wrote it, it will be backed up before it is overwritten", path)
+		return true, nil
+	default:
+		log.Printf("File: %s has been edited since ekstrap wrote it, the edits will be overwritten", path)
+		return false, nil
+	}
+}
+
+// Prune stages the removal of any files in the Manifest that aren't in
+// keep, and an update to the Manifest to list the files in keep.
+//
+// It returns true if any files will be removed, it does nothing if there
+// is no Manifest.
+func (t *Transaction) Prune(keep []string) (bool, error) {
+	if t.Manifest == "" {
+		return false, nil
+	}
+	orphans, err := orphans(t.Root, t.Manifest, keep)
+	if err != nil {
+		return false, err
+	}
+	for _, orphan := range orphans {
+		log.Printf("File: %s is no longer managed by ekstrap, it will be removed", rooted(t.Root, orphan))
+	}
+	t.pruning = true
+	t.keep = keep
+	t.orphans = orphans
+	return len(orphans) > 0, nil
+}
+
+// Restore stages the files kept in the Generation to be written back by
+// Commit, with the permissions and ownership they had, and the removal of any
+// files in the Manifest that aren't in the Generation.
+//
+// meta gives the DirMode and Redact of each file by name, if it is known. It
+// returns the names of the files that committing will change. As with any
+// other commit, the files that are replaced become the Generation.
+func (t *Transaction) Restore(meta map[string]Metadata) ([]string, error) {
+	if t.Generation == "" {
+		return nil, errors.New("the previous generation of config isn't kept")
+	}
+	dir := rooted(t.Root, t.Generation)
+	var names, changes []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := "/" + filepath.ToSlash(rel)
+		if name == t.Manifest {
+			return nil
+		}
+		prev, err := read(path)
+		if err != nil {
+			return err
+		}
+		m := meta[name]
+		m.Mode, m.UID, m.GID = prev.meta.Mode, prev.meta.UID, prev.meta.GID
+		changed, err := t.Sync(bytes.NewReader(prev.data), name, m)
+		if err != nil {
+			return fmt.Errorf("couldn't restore %s: %v", name, err)
+		}
+		names = append(names, name)
+		if changed {
+			changes = append(changes, name)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) || err == nil && len(names) == 0 {
+		return nil, fmt.Errorf("there is no previous generation of config in %s", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.Prune(names); err != nil {
+		return nil, err
+	}
+	return append(changes, t.orphans...), nil
+}
+
+// Commit writes all of the staged files.
+//
+// Files whose contents haven't changed are left alone, but their permissions
+// and ownership are corrected if they have drifted. If any file can't be
+// written, the files that already have been are rolled back.
+func (t *Transaction) Commit() error {
+	staged := t.staged
+	t.staged = nil
+	defer func() {
+		for _, s := range staged {
+			s.file.Close()
+		}
+	}()
+	if err := t.commitAll(staged); err != nil {
+		if rerr := t.Rollback(); rerr != nil {
+			return fmt.Errorf("%v, and couldn't roll back the other files: %v", err, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *Transaction) commitAll(staged []*staged) error {
+	if t.Generation != "" {
+		if err := t.keepGeneration(staged); err != nil {
+			return fmt.Errorf("couldn't keep the previous generation of config in %s: %v", rooted(t.Root, t.Generation), err)
+		}
+	}
+	now := time.Now()
+	for _, s := range staged {
+		if s.backup {
+			if err := t.backup(s, now); err != nil {
+				return fmt.Errorf("couldn't back up %s: %v", s.path, err)
+			}
+		}
+		if err := t.commit(s); err != nil {
+			return fmt.Errorf("couldn't write %s: %v", s.path, err)
+		}
+	}
+	if !t.pruning {
+		return nil
+	}
+	t.pruning = false
+	for _, orphan := range t.orphans {
+		orphan = rooted(t.Root, orphan)
+		if err := t.remove(orphan); err != nil {
+			return fmt.Errorf("couldn't remove %s: %v", orphan, err)
+		}
+	}
+	manifest := rooted(t.Root, t.Manifest)
+	data, err := newManifest(t.Root, t.keep)
+	if err == nil {
+		err = t.write(manifest, data, manifestMetadata)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write the manifest %s: %v", manifest, err)
+	}
+	return nil
+}
+
+func (t *Transaction) commit(s *staged) error {
+	prev, err := read(s.path)
+	if err != nil {
+		return err
+	}
+	if !s.changed {
+		if prev.existed && s.meta.drifted(prev.meta) {
+			log.Printf("File: %s will have its permissions and ownership changed from %s to %s", s.path, prev.meta, s.meta)
+			t.previous = append(t.previous, prev)
+			return s.meta.correct(s.path)
+		}
+		return nil
+	}
+	t.previous = append(t.previous, prev)
+	if err := s.file.Commit(); err != nil {
+		return err
+	}
+	// The mode the file was created with is subject to the umask
+	return s.meta.correct(s.path)
+}
+
+// keepGeneration replaces the Generation with a copy of the staged files,
+// the orphans and the Manifest as they are now, if committing will change any of them.
+//
+// Files that don't exist aren't copied, so the Generation is just like the
+// Root as it was.
+func (t *Transaction) keepGeneration(staged []*staged) error {
+	changes := t.pruning && len(t.orphans) > 0
+	var names []string
+	for _, s := range staged {
+		names = append(names, s.name)
+		if changes || s.changed {
+			changes = true
+			continue
+		}
+		prev, err := read(s.path)
+		if err != nil {
+			return err
+		}
+		changes = prev.existed && s.meta.drifted(prev.meta)
+	}
+	if !changes {
+		return nil
+	}
+	if t.pruning {
+		names = append(append(names, t.orphans...), t.Manifest)
+	}
+
+	dir := rooted(t.Root, t.Generation)
+	next := dir + ".new"
+	if err := os.MkdirAll(filepath.Dir(dir), manifestMetadata.DirMode); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(next); err != nil {
+		return err
+	}
+	for _, name := range names {
+		prev, err := read(rooted(t.Root, name))
+		if err != nil {
+			return err
+		}
+		if !prev.existed {
+			continue
+		}
+		path := filepath.Join(next, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := writeFile(path, prev.data, prev.meta); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(next, 0700); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(next, dir); err != nil {
+		return err
+	}
+	log.Printf("The previous generation of config has been kept in %s", dir)
+	return nil
+}
+
+// backup copies the file that s will replace into the backups directory
+func (t *Transaction) backup(s *staged, now time.Time) error {
+	prev, err := read(s.path)
+	if err != nil || !prev.existed {
+		return err
+	}
+	path := backupPath(t.Root, t.Manifest, s.name, now)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	log.Printf("File: %s has been backed up to %s", s.path, path)
+	return writeFile(path, prev.data, prev.meta)
+}
+
+// remove removes the file at path, so that it can be restored by Rollback
+func (t *Transaction) remove(path string) error {
+	prev, err := read(path)
+	if err != nil {
+		return err
+	}
+	t.previous = append(t.previous, prev)
+	return os.Remove(path)
+}
+
+// write writes data to the file at path straight away, unless it is unchanged,
+// so that it can be restored by Rollback
+func (t *Transaction) write(path string, data []byte, meta Metadata) error {
+	prev, err := read(path)
+	if err != nil || prev.existed && bytes.Equal(prev.data, data) {
+		return err
+	}
+	if err := t.mkdirAll(filepath.Dir(path), meta.DirMode); err != nil {
+		return err
+	}
+	t.previous = append(t.previous, prev)
+	return writeFile(path, data, meta)
+}
+
+// Rollback restores the files changed by Commit to how they were before, files
+// that didn't exist are removed, as are any directories created for them.
+//
+// Rolling back carries on if a file can't be restored, the first error is returned.
+func (t *Transaction) Rollback() error {
+	var first error
+	keep := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	for _, s := range t.staged {
+		s.file.Close()
+	}
+	t.staged = nil
+	for i := len(t.previous) - 1; i >= 0; i-- {
+		keep(t.previous[i].restore())
+	}
+	t.previous = nil
+	for i := len(t.createdAt) - 1; i >= 0; i-- {
+		// Only remove directories that are empty again
+		if err := os.Remove(t.createdAt[i]); err != nil && !os.IsNotExist(err) && !isNotEmpty(err) {
+			keep(err)
+		}
+	}
+	t.createdAt = nil
+	t.pruning = false
+	return first
+}
+
+// mkdirAll is like os.MkdirAll, but records the directories it creates
+func (t *Transaction) mkdirAll(dir string, mode os.FileMode) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, d)
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		t.createdAt = append(t.createdAt, missing[i])
+	}
+	return nil
+}
+
+// read records the current state of the file at path
+func read(path string) (previous, error) {
+	prev := previous{path: path}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return prev, nil
+	}
+	if err != nil {
+		return prev, err
+	}
+	if prev.data, err = ioutil.ReadFile(path); err != nil {
+		return prev, err
+	}
+	prev.existed = true
+	prev.meta = metadataOf(info)
+	return prev, nil
+}
+
+func (p previous) restore() error {
+	if !p.existed {
+		log.Printf("File: %s will be removed", p.path)
+		if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	log.Printf("File: %s will be restored to its previous version", p.path)
+	return writeFile(p.path, p.data, p.meta)
+}
+
+// writeFile atomicly writes data to the file at path with the given permissions and ownership
+func writeFile(path string, data []byte, meta Metadata) error {
+	f, err := safefile.Create(path, meta.Mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Commit(); err != nil {
+		return err
+	}
+	return meta.correct(path)
+}
+
+func isNotEmpty(err error) bool {
+	if perr, ok := err.(*os.PathError); ok {
+		return perr.Err == syscall.ENOTEMPTY || perr.Err == syscall.EEXIST
+	}
+	return false
+}
@@ -0,0 +1,371 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pkg "github.com/errm/ekstrap/pkg/file"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	existing := filepath.Join(dir, "existing")
+	check(t, ioutil.WriteFile(existing, []byte("Old contents"), 0644))
+
+	tx := &pkg.Transaction{Root: dir}
+	_, err = tx.Sync(strings.NewReader("New contents"), "/existing", pkg.Metadata{Mode: 0644})
+	check(t, err)
+	_, err = tx.Sync(strings.NewReader("Hello World"), "/subdir/new", pkg.Metadata{Mode: 0640})
+	check(t, err)
+
+	// Nothing is written until the transaction is committed
+	expectContents(t, existing, "Old contents")
+	expectMissing(t, filepath.Join(dir, "subdir", "new"))
+
+	check(t, tx.Commit())
+	expectContents(t, existing, "New contents")
+	expectContents(t, filepath.Join(dir, "subdir", "new"), "Hello World")
+}
+
+func TestTransactionRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	existing := filepath.Join(dir, "existing")
+	check(t, ioutil.WriteFile(existing, []byte("Old contents"), 0600))
+	check(t, os.Chmod(existing, 0600))
+
+	tx := &pkg.Transaction{Root: dir}
+	_, err = tx.Sync(strings.NewReader("New contents"), "/existing", pkg.Metadata{Mode: 0644})
+	check(t, err)
+	_, err = tx.Sync(strings.NewReader("Hello World"), "/subdir/new", pkg.Metadata{Mode: 0640})
+	check(t, err)
+	check(t, tx.Commit())
+
+	check(t, tx.Rollback())
+	expectContents(t, existing, "Old contents")
+	info, err := os.Stat(existing)
+	check(t, err)
+	if info.Mode() != 0600 {
+		t.Errorf("Expecting the previous mode: %s, got %s", os.FileMode(0600), info.Mode())
+	}
+	expectMissing(t, filepath.Join(dir, "subdir", "new"))
+	expectMissing(t, filepath.Join(dir, "subdir"))
+}
+
+func TestTransactionCommitFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	existing := filepath.Join(dir, "existing")
+	check(t, ioutil.WriteFile(existing, []byte("Old contents"), 0644))
+
+	tx := &pkg.Transaction{Root: dir}
+	_, err = tx.Sync(strings.NewReader("New contents"), "/existing", pkg.Metadata{Mode: 0644})
+	check(t, err)
+	_, err = tx.Sync(strings.NewReader("Hello World"), "/blocked", pkg.Metadata{Mode: 0644})
+	check(t, err)
+
+	// Something gets in the way of the second file before it is committed
+	check(t, os.MkdirAll(filepath.Join(dir, "blocked", "in-the-way"), 0755))
+
+	err = tx.Commit()
+	if err == nil || !strings.Contains(err.Error(), "couldn't write "+filepath.Join(dir, "blocked")) {
+		t.Errorf("Expected an error writing the blocked file, got %v", err)
+	}
+	expectContents(t, existing, "Old contents")
+}
+
+func expectContents(t *testing.T, path, expected string) {
+	t.Helper()
+	contents, err := ioutil.ReadFile(path)
+	check(t, err)
+	if string(contents) != expected {
+		t.Errorf("Unexpected contents of %s: %s", path, contents)
+	}
+}
+
+func expectMissing(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected %s not to exist", path)
+	}
+}
+
+func TestTransactionPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	manifest := "/var/lib/ekstrap/manifest.json"
+	tx := &pkg.Transaction{Root: dir, Manifest: manifest}
+	for _, path := range []string{"/etc/kept", "/etc/removed", "/etc/edited"} {
+		_, err = tx.Sync(strings.NewReader("contents of "+path), path, pkg.Metadata{})
+		check(t, err)
+	}
+	pruned, err := tx.Prune([]string{"/etc/kept", "/etc/removed", "/etc/edited"})
+	check(t, err)
+	if pruned {
+		t.Errorf("Expected nothing to be pruned without a manifest")
+	}
+	check(t, tx.Commit())
+	written, err := ioutil.ReadFile(filepath.Join(dir, manifest))
+	check(t, err)
+
+	// Someone else has edited one of the files
+	check(t, ioutil.WriteFile(filepath.Join(dir, "etc", "edited"), []byte("edited"), 0640))
+
+	// A dry run only reports what would be removed
+	dryRun := &pkg.Atomic{Root: dir, DryRun: true, Manifest: manifest}
+	pruned, err = dryRun.Prune([]string{"/etc/kept"})
+	check(t, err)
+	if !pruned {
+		t.Errorf("Expected a file to be pruned")
+	}
+	expectContents(t, filepath.Join(dir, "etc", "removed"), "contents of /etc/removed")
+
+	tx = &pkg.Transaction{Root: dir, Manifest: manifest}
+	_, err = tx.Sync(strings.NewReader("contents of /etc/kept"), "/etc/kept", pkg.Metadata{})
+	check(t, err)
+	pruned, err = tx.Prune([]string{"/etc/kept"})
+	check(t, err)
+	if !pruned {
+		t.Errorf("Expected a file to be pruned")
+	}
+	expectContents(t, filepath.Join(dir, "etc", "removed"), "contents of /etc/removed")
+	check(t, tx.Commit())
+
+	expectMissing(t, filepath.Join(dir, "etc", "removed"))
+	expectContents(t, filepath.Join(dir, "etc", "edited"), "edited")
+	expectContents(t, filepath.Join(dir, "etc", "kept"), "contents of /etc/kept")
+	expectContents(t, filepath.Join(dir, manifest), `{
+  "files": [
+    {
+      "path": "/etc/kept",
+      "sha256": "b0779648bbf9aeab0b28ad79e77d886e4826e9c4bcebee2c491c465bda1f5936"
+    }
+  ]
+}
+`)
+
+	// Rolling back restores the removed file, and the manifest
+	check(t, tx.Rollback())
+	expectContents(t, filepath.Join(dir, "etc", "removed"), "contents of /etc/removed")
+	expectContents(t, filepath.Join(dir, manifest), string(written))
+}
+
+func TestTransactionDrift(t *testing.T) {
+	manifest := "/var/lib/ekstrap/manifest.json"
+	setup := func(t *testing.T) string {
+		dir, err := ioutil.TempDir("", "")
+		check(t, err)
+		tx := &pkg.Transaction{Root: dir, Manifest: manifest}
+		_, err = tx.Sync(strings.NewReader("written by ekstrap\n"), "/etc/config.yaml", pkg.Metadata{})
+		check(t, err)
+		_, err = tx.Prune([]string{"/etc/config.yaml"})
+		check(t, err)
+		check(t, tx.Commit())
+		// An operator edits the file by hand
+		check(t, ioutil.WriteFile(filepath.Join(dir, "etc", "config.yaml"), []byte("edited by hand\n"), 0640))
+		return dir
+	}
+
+	testCases := []struct {
+		desc     string
+		policy   pkg.DriftPolicy
+		err      string
+		contents string
+		backup   bool
+	}{
+		{
+			desc:     "warn",
+			policy:   pkg.DriftWarn,
+			contents: "new contents\n",
+		},
+		{
+			desc:     "default",
+			contents: "new contents\n",
+		},
+		{
+			desc:     "refuse",
+			policy:   pkg.DriftRefuse,
+			err:      "has been edited since ekstrap wrote it, refusing to overwrite it",
+			contents: "edited by hand\n",
+		},
+		{
+			desc:     "backup",
+			policy:   pkg.DriftBackup,
+			contents: "new contents\n",
+			backup:   true,
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			dir := setup(t)
+			defer os.RemoveAll(dir) //cleanup
+
+			tx := &pkg.Transaction{Root: dir, Manifest: manifest, Drift: tC.policy}
+			_, err := tx.Sync(strings.NewReader("new contents\n"), "/etc/config.yaml", pkg.Metadata{})
+			if tC.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tC.err) {
+					t.Errorf("Expected an error containing %q, got %v", tC.err, err)
+				}
+				check(t, tx.Rollback())
+			} else {
+				check(t, err)
+				check(t, tx.Commit())
+			}
+			expectContents(t, filepath.Join(dir, "etc", "config.yaml"), tC.contents)
+
+			backups, err := filepath.Glob(filepath.Join(dir, "var", "lib", "ekstrap", "backups", "*", "etc", "config.yaml"))
+			check(t, err)
+			if !tC.backup {
+				if len(backups) != 0 {
+					t.Errorf("Expected no backups, got %v", backups)
+				}
+				return
+			}
+			if len(backups) != 1 {
+				t.Fatalf("Expected 1 backup, got %v", backups)
+			}
+			expectContents(t, backups[0], "edited by hand\n")
+		})
+	}
+}
+
+func TestTransactionGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	manifest := "/var/lib/ekstrap/manifest.json"
+	generation := "/var/lib/ekstrap/previous"
+	commit := func(files map[string]string) {
+		tx := &pkg.Transaction{Root: dir, Manifest: manifest, Generation: generation}
+		var keep []string
+		for path, contents := range files {
+			_, err := tx.Sync(strings.NewReader(contents), path, pkg.Metadata{})
+			check(t, err)
+			keep = append(keep, path)
+		}
+		_, err := tx.Prune(keep)
+		check(t, err)
+		check(t, tx.Commit())
+	}
+
+	// There is no previous generation the first time
+	commit(map[string]string{"/etc/a": "a1", "/etc/b": "b1"})
+	expectMissing(t, filepath.Join(dir, generation, "etc", "a"))
+	expectMissing(t, filepath.Join(dir, generation, manifest))
+	written, err := ioutil.ReadFile(filepath.Join(dir, manifest))
+	check(t, err)
+
+	commit(map[string]string{"/etc/a": "a2", "/etc/c": "c2"})
+	expectContents(t, filepath.Join(dir, generation, "etc", "a"), "a1")
+	expectContents(t, filepath.Join(dir, generation, "etc", "b"), "b1")
+	expectMissing(t, filepath.Join(dir, generation, "etc", "c"))
+	expectContents(t, filepath.Join(dir, generation, manifest), string(written))
+	expectMissing(t, filepath.Join(dir, "etc", "b"))
+
+	// Nothing changes, so the previous generation is kept
+	commit(map[string]string{"/etc/a": "a2", "/etc/c": "c2"})
+	expectContents(t, filepath.Join(dir, generation, "etc", "a"), "a1")
+	expectContents(t, filepath.Join(dir, generation, "etc", "b"), "b1")
+
+	commit(map[string]string{"/etc/a": "a3", "/etc/c": "c2"})
+	expectContents(t, filepath.Join(dir, generation, "etc", "a"), "a2")
+	expectContents(t, filepath.Join(dir, generation, "etc", "c"), "c2")
+	expectMissing(t, filepath.Join(dir, generation, "etc", "b"))
+	expectMissing(t, filepath.Join(dir, generation+".new"))
+}
+
+func TestTransactionRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	check(t, err)
+	defer os.RemoveAll(dir) //cleanup
+
+	manifest := "/var/lib/ekstrap/manifest.json"
+	generation := "/var/lib/ekstrap/previous"
+	newTx := func() *pkg.Transaction {
+		return &pkg.Transaction{Root: dir, Manifest: manifest, Generation: generation}
+	}
+
+	if _, err := newTx().Restore(nil); err == nil {
+		t.Error("expected an error when there is no previous generation")
+	}
+
+	tx := newTx()
+	_, err = tx.Sync(strings.NewReader("a1"), "/etc/a", pkg.Metadata{})
+	check(t, err)
+	_, err = tx.Sync(strings.NewReader("b1"), "/etc/b", pkg.Metadata{Mode: 0600})
+	check(t, err)
+	_, err = tx.Prune([]string{"/etc/a", "/etc/b"})
+	check(t, err)
+	check(t, tx.Commit())
+	written, err := ioutil.ReadFile(filepath.Join(dir, manifest))
+	check(t, err)
+
+	tx = newTx()
+	_, err = tx.Sync(strings.NewReader("a2"), "/etc/a", pkg.Metadata{})
+	check(t, err)
+	_, err = tx.Sync(strings.NewReader("c2"), "/etc/c", pkg.Metadata{})
+	check(t, err)
+	_, err = tx.Prune([]string{"/etc/a", "/etc/c"})
+	check(t, err)
+	check(t, tx.Commit())
+
+	tx = newTx()
+	changed, err := tx.Restore(nil)
+	check(t, err)
+	if strings.Join(changed, " ") != "/etc/a /etc/b /etc/c" {
+		t.Errorf("expected /etc/a, /etc/b and /etc/c to change, got %v", changed)
+	}
+	// Nothing is written until the transaction is committed
+	expectContents(t, filepath.Join(dir, "etc", "a"), "a2")
+	check(t, tx.Commit())
+	expectContents(t, filepath.Join(dir, "etc", "a"), "a1")
+	expectContents(t, filepath.Join(dir, "etc", "b"), "b1")
+	expectMissing(t, filepath.Join(dir, "etc", "c"))
+	expectContents(t, filepath.Join(dir, manifest), string(written))
+	info, err := os.Stat(filepath.Join(dir, "etc", "b"))
+	check(t, err)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected /etc/b to be restored with mode 0600, got %04o", info.Mode().Perm())
+	}
+
+	// The files that were replaced are kept, so restoring again undoes it
+	expectContents(t, filepath.Join(dir, generation, "etc", "a"), "a2")
+	expectContents(t, filepath.Join(dir, generation, "etc", "c"), "c2")
+	tx = newTx()
+	_, err = tx.Restore(nil)
+	check(t, err)
+	check(t, tx.Commit())
+	expectContents(t, filepath.Join(dir, "etc", "a"), "a2")
+	expectContents(t, filepath.Join(dir, "etc", "c"), "c2")
+	expectMissing(t, filepath.Join(dir, "etc", "b"))
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/errm/ekstrap/pkg/backoff"
+)
+
+const (
+	// DefaultEndpoint is the address of the EC2 instance metadata service
+	DefaultEndpoint = "http://169.254.169.254"
+
+	// EndpointEnvVar can be used to point ekstrap at a different (e.g. fake) metadata service
+	EndpointEnvVar = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+
+	tokenTTL        = 6 * time.Hour
+	tokenTTLHeader  = "X-aws-ec2-metadata-token-ttl-seconds"
+	tokenHeader     = "X-aws-ec2-metadata-token"
+	tokenSafetyTime = time.Minute
+)
+
+var b = backoff.Backoff{Seq: []int{1, 1, 2, 4}}
+
+// Client is a client for the EC2 instance metadata service.
+//
+// It uses IMDSv2 session tokens, refreshing them before they expire, so works
+// on instances where they are required (HttpTokens=required). If the metadata
+// service doesn't support tokens it falls back to IMDSv1. Transient failures
+// are retried with a backoff, until the context passed to each method is done.
+type Client struct {
+	Endpoint   string
+	HTTPClient *http.Client
+
+	now func() time.Time
+
+	mu       sync.Mutex
+	token    string
+	expiry   time.Time
+	tokenErr error
+}
+
+// New returns a Client for the metadata service at the endpoint given by
+// AWS_EC2_METADATA_SERVICE_ENDPOINT, or the default endpoint if it is unset
+func New() *Client {
+	endpoint := os.Getenv(EndpointEnvVar)
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	return &Client{
+		Endpoint:   strings.TrimSuffix(endpoint, "/"),
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// statusError is returned when the metadata service responds with an unexpected status
+type statusError struct {
+	path   string
+	status int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("the metadata service responded to %s with %d %s", e.path, e.status, http.StatusText(e.status))
+}
+
+// IsNotFound returns true if err was caused by the requested metadata not existing
+func IsNotFound(err error) bool {
+	serr, ok := err.(statusError)
+	return ok && serr.status == http.StatusNotFound
+}
+
+// GetMetadata returns the metadata at the given path e.g. instance-id
+func (c *Client) GetMetadata(ctx context.Context, path string) (string, error) {
+	return c.get(ctx, "/latest/meta-data/"+path)
+}
+
+// GetDynamicData returns the dynamic data at the given path e.g. instance-identity/document
+func (c *Client) GetDynamicData(ctx context.Context, path string) (string, error) {
+	return c.get(ctx, "/latest/dynamic/"+path)
+}
+
+// IdentityDocument describes the instance
+type IdentityDocument struct {
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	Region           string `json:"region"`
+	AvailabilityZone string `json:"availabilityZone"`
+	Architecture     string `json:"architecture"`
+	PrivateIP        string `json:"privateIp"`
+}
+
+// IdentityDocument returns the instance identity document
+func (c *Client) IdentityDocument(ctx context.Context) (IdentityDocument, error) {
+	var doc IdentityDocument
+	data, err := c.GetDynamicData(ctx, "instance-identity/document")
+	if err != nil {
+		return doc, err
+	}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return doc, fmt.Errorf("couldn't parse the instance identity document: %v", err)
+	}
+	return doc, nil
+}
+
+// Region returns the region that the instance is running in
+func (c *Client) Region(ctx context.Context) (string, error) {
+	doc, err := c.IdentityDocument(ctx)
+	return doc.Region, err
+}
+
+// get requests path, retrying with a backoff, if ctx is done before it
+// succeeds the reason from ctx is returned
+func (c *Client) get(ctx context.Context, path string) (string, error) {
+	var err error
+	for tries := 1; ; tries++ {
+		var body string
+		var retry bool
+		body, retry, err = c.try(ctx, path)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err == nil || !retry || tries > len(b.Seq) {
+			return body, err
+		}
+		sleepFor := b.Duration(tries)
+		log.Printf("Request to the metadata service failed: %v, will try again in %s", err, sleepFor)
+		if err := backoff.Wait(ctx, sleepFor); err != nil {
+			return "", err
+		}
+	}
+}
+
+// try makes a single request for path, it returns true if the request
+// failed in a way that is worth retrying.
+func (c *Client) try(ctx context.Context, path string) (string, bool, error) {
+	token, err := c.sessionToken(ctx)
+	if err != nil {
+		return "", true, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Endpoint+path, nil)
+	if err != nil {
+		return "", false, err
+	}
+	if token != "" {
+		req.Header.Set(tokenHeader, token)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", true, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return string(body), false, nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		// Our token has expired or been invalidated, or we couldn't get one at all
+		if terr := c.invalidateToken(); terr != nil {
+			return "", false, terr
+		}
+		return "", true, statusError{path: path, status: resp.StatusCode}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return "", true, statusError{path: path, status: resp.StatusCode}
+	default:
+		return "", false, statusError{path: path, status: resp.StatusCode}
+	}
+}
+
+// sessionToken returns an IMDSv2 session token, requesting a new one if we
+// don't have one, or it is about to expire.
+//
+// An empty token is returned if the metadata service doesn't support IMDSv2,
+// or if we couldn't get a token, so we can try IMDSv1 instead.
+func (c *Client) sessionToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && c.clock().Before(c.expiry) {
+		return c.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.Endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(tokenTTLHeader, strconv.Itoa(int(tokenTTL/time.Second)))
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		if isTimeout(err) {
+			// When the PUT response hop limit is too low for a container to
+			// reach the metadata service, the request times out
+			c.tokenErr = fmt.Errorf("requesting an IMDSv2 session token timed out, if ekstrap is running in a container the instance's metadata hop limit (HttpPutResponseHopLimit) probably needs to be increased to at least 2: %v", err)
+			return "", nil
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		c.token = string(body)
+		c.expiry = c.clock().Add(tokenTTL - tokenSafetyTime)
+		c.tokenErr = nil
+		return c.token, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		// This metadata service only supports IMDSv1
+		return "", nil
+	case resp.StatusCode == http.StatusForbidden:
+		c.tokenErr = errors.New("the metadata service refused to issue an IMDSv2 session token, it may have been disabled (HttpEndpoint=disabled)")
+		return "", nil
+	default:
+		return "", statusError{path: "/latest/api/token", status: resp.StatusCode}
+	}
+}
+
+// invalidateToken discards our token so a new one will be requested.
+//
+// If we weren't able to get a token in the first place, IMDSv2 must be
+// required, so the reason we couldn't get one is returned.
+func (c *Client) invalidateToken() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" && c.tokenErr != nil {
+		return c.tokenErr
+	}
+	c.token = ""
+	return nil
+}
+
+func (c *Client) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
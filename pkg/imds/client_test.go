@@ -0,0 +1,311 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/errm/ekstrap/pkg/backoff"
+)
+
+func disableBackoff() {
+	// An empty backoff just returns 0 all the time so the tests run fast
+	b = backoff.Backoff{Seq: []int{0, 0, 0, 0}}
+}
+
+// fakeIMDS is a fake instance metadata service
+type fakeIMDS struct {
+	mu sync.Mutex
+	// data is the metadata served, by path e.g. /latest/meta-data/instance-id
+	data map[string]string
+	// tokensRequired is like HttpTokens=required
+	tokensRequired bool
+	// v1Only simulates a metadata service that doesn't support IMDSv2
+	v1Only bool
+	// tokenDelay delays responses to token requests, like a hop limit that is too low
+	tokenDelay time.Duration
+	// failures is the number of requests to fail with a 500 before succeeding
+	failures int
+
+	tokens       map[string]bool
+	tokenCount   int
+	tokenTTLs    []string
+	getRequests  int
+	lastGetToken string
+}
+
+func newFakeIMDS(data map[string]string) *fakeIMDS {
+	return &fakeIMDS{data: data, tokens: make(map[string]bool)}
+}
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && r.URL.Path == "/latest/api/token" {
+		f.serveToken(w, r)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.getRequests++
+	token := r.Header.Get(tokenHeader)
+	f.lastGetToken = token
+	if token != "" && !f.tokens[token] || token == "" && f.tokensRequired {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	value, ok := f.data[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, value)
+}
+
+func (f *fakeIMDS) serveToken(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(f.tokenDelay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.v1Only {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.tokenCount++
+	f.tokenTTLs = append(f.tokenTTLs, r.Header.Get(tokenTTLHeader))
+	token := fmt.Sprintf("token-%d", f.tokenCount)
+	f.tokens[token] = true
+	fmt.Fprint(w, token)
+}
+
+// revokeTokens invalidates all the tokens that have been issued
+func (f *fakeIMDS) revokeTokens() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens = make(map[string]bool)
+}
+
+func newTestClient(f *fakeIMDS) (*Client, func()) {
+	disableBackoff()
+	server := httptest.NewServer(f)
+	c := &Client{
+		Endpoint:   server.URL,
+		HTTPClient: &http.Client{Timeout: time.Second},
+	}
+	return c, server.Close
+}
+
+func TestGetMetadataWithToken(t *testing.T) {
+	f := newFakeIMDS(map[string]string{"/latest/meta-data/instance-id": "i-1234"})
+	f.tokensRequired = true
+	c, done := newTestClient(f)
+	defer done()
+
+	for i := 0; i < 3; i++ {
+		id, err := c.GetMetadata(context.Background(), "instance-id")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if id != "i-1234" {
+			t.Errorf("expected i-1234, got %s", id)
+		}
+	}
+
+	if f.tokenCount != 1 {
+		t.Errorf("expected the token to be reused, but %d were requested", f.tokenCount)
+	}
+	if f.tokenTTLs[0] != "21600" {
+		t.Errorf("expected a token TTL of 21600 seconds, got %s", f.tokenTTLs[0])
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	f := newFakeIMDS(map[string]string{"/latest/meta-data/instance-id": "i-1234"})
+	f.tokensRequired = true
+	c, done := newTestClient(f)
+	defer done()
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	if _, err := c.GetMetadata(context.Background(), "instance-id"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Just before the token expires we should get a new one
+	now = now.Add(tokenTTL - tokenSafetyTime + time.Second)
+	if _, err := c.GetMetadata(context.Background(), "instance-id"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.tokenCount != 2 {
+		t.Errorf("expected the token to be refreshed, %d tokens were requested", f.tokenCount)
+	}
+	if f.lastGetToken != "token-2" {
+		t.Errorf("expected the new token to be used, got %s", f.lastGetToken)
+	}
+
+	// If the token is rejected we should get a new one and try again
+	f.revokeTokens()
+	if _, err := c.GetMetadata(context.Background(), "instance-id"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.tokenCount != 3 {
+		t.Errorf("expected the token to be refreshed, %d tokens were requested", f.tokenCount)
+	}
+}
+
+func TestIMDSv1Fallback(t *testing.T) {
+	f := newFakeIMDS(map[string]string{"/latest/meta-data/instance-id": "i-1234"})
+	f.v1Only = true
+	c, done := newTestClient(f)
+	defer done()
+
+	id, err := c.GetMetadata(context.Background(), "instance-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "i-1234" {
+		t.Errorf("expected i-1234, got %s", id)
+	}
+	if f.lastGetToken != "" {
+		t.Errorf("expected no token to be sent, got %s", f.lastGetToken)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	f := newFakeIMDS(map[string]string{"/latest/meta-data/instance-id": "i-1234"})
+	f.failures = 2
+	c, done := newTestClient(f)
+	defer done()
+
+	id, err := c.GetMetadata(context.Background(), "instance-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "i-1234" {
+		t.Errorf("expected i-1234, got %s", id)
+	}
+	if f.getRequests != 3 {
+		t.Errorf("expected 3 requests, got %d", f.getRequests)
+	}
+
+	f.failures = 10
+	f.getRequests = 0
+	_, err = c.GetMetadata(context.Background(), "instance-id")
+	if err == nil || !strings.Contains(err.Error(), "500 Internal Server Error") {
+		t.Errorf("expected the last error to be returned, got %v", err)
+	}
+	if f.getRequests != len(b.Seq)+1 {
+		t.Errorf("expected %d requests, got %d", len(b.Seq)+1, f.getRequests)
+	}
+
+	f.failures = 0
+	f.getRequests = 0
+	_, err = c.GetMetadata(context.Background(), "does-not-exist")
+	if !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if f.getRequests != 1 {
+		t.Errorf("expected not found errors not to be retried, but %d requests were made", f.getRequests)
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	f := newFakeIMDS(map[string]string{"/latest/meta-data/instance-id": "i-1234"})
+	f.failures = 100
+	c, done := newTestClient(f)
+	defer done()
+	// A backoff much longer than the test, so it only ends if the wait is cancelled
+	b = backoff.Backoff{Seq: []int{60}}
+	defer disableBackoff()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.GetMetadata(ctx, "instance-id"); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to stop retrying when the context was done, took %s", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	p := &RoleProvider{Client: c, Context: ctx}
+	if _, err := p.Retrieve(); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestHopLimit(t *testing.T) {
+	f := newFakeIMDS(map[string]string{"/latest/meta-data/instance-id": "i-1234"})
+	f.tokensRequired = true
+	f.tokenDelay = 100 * time.Millisecond
+	c, done := newTestClient(f)
+	defer done()
+	c.HTTPClient.Timeout = 20 * time.Millisecond
+
+	_, err := c.GetMetadata(context.Background(), "instance-id")
+	if err == nil || !strings.Contains(err.Error(), "HttpPutResponseHopLimit") {
+		t.Errorf("expected an error about the hop limit, got %v", err)
+	}
+
+	// If tokens are optional we can carry on with IMDSv1
+	f.tokensRequired = false
+	c, done = newTestClient(f)
+	defer done()
+	c.HTTPClient.Timeout = 20 * time.Millisecond
+	id, err := c.GetMetadata(context.Background(), "instance-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "i-1234" {
+		t.Errorf("expected i-1234, got %s", id)
+	}
+}
+
+func TestRegion(t *testing.T) {
+	f := newFakeIMDS(map[string]string{
+		"/latest/dynamic/instance-identity/document": `{
+			"instanceId": "i-1234",
+			"instanceType": "m5.large",
+			"region": "eu-west-1",
+			"availabilityZone": "eu-west-1a",
+			"architecture": "x86_64",
+			"privateIp": "10.0.0.1"
+		}`,
+	})
+	c, done := newTestClient(f)
+	defer done()
+
+	region, err := c.Region(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if region != "eu-west-1" {
+		t.Errorf("expected eu-west-1, got %s", region)
+	}
+}
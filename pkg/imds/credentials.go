@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// ProviderName is the name of the credentials provider for the instance role
+const ProviderName = "IMDSRoleProvider"
+
+// Credentials returns credentials for the instance's IAM role, fetched with c.
+//
+// Credentials from the environment or the shared credentials file take
+// precedence, as they do with the default AWS SDK credentials chain.
+// Unlike the SDK's own EC2 role provider this works when IMDSv2 is required.
+// Retrieving them gives up when ctx is done.
+func (c *Client) Credentials(ctx context.Context) *credentials.Credentials {
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{},
+		&RoleProvider{Client: c, Context: ctx},
+	})
+}
+
+// RoleProvider retrieves credentials for the instance's IAM role from the metadata service
+type RoleProvider struct {
+	credentials.Expiry
+	Client *Client
+	// Context is used for the requests to the metadata service, as the
+	// credentials.Provider interface doesn't pass one, context.Background() if it is nil
+	Context context.Context
+}
+
+type roleCredentials struct {
+	Code            string
+	Message         string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// Retrieve fetches the instance role's credentials from the metadata service
+func (p *RoleProvider) Retrieve() (credentials.Value, error) {
+	ctx := p.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	roles, err := p.Client.GetMetadata(ctx, "iam/security-credentials/")
+	if IsNotFound(err) {
+		return credentials.Value{ProviderName: ProviderName}, errors.New("this instance doesn't have an IAM instance profile")
+	}
+	if err != nil {
+		return credentials.Value{ProviderName: ProviderName}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return credentials.Value{ProviderName: ProviderName}, errors.New("this instance doesn't have an IAM instance profile")
+	}
+
+	data, err := p.Client.GetMetadata(ctx, "iam/security-credentials/"+role)
+	if err != nil {
+		return credentials.Value{ProviderName: ProviderName}, err
+	}
+	var creds roleCredentials
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		return credentials.Value{ProviderName: ProviderName}, fmt.Errorf("couldn't parse the credentials for the %s role: %v", role, err)
+	}
+	if creds.Code != "Success" {
+		return credentials.Value{ProviderName: ProviderName}, fmt.Errorf("couldn't get credentials for the %s role: %s %s", role, creds.Code, creds.Message)
+	}
+
+	p.SetExpiration(creds.Expiration, 5*time.Minute)
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		ProviderName:    ProviderName,
+	}, nil
+}
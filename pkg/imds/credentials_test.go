@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imds
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoleProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	f := newFakeIMDS(map[string]string{
+		"/latest/meta-data/iam/security-credentials/": "node-role\n",
+		"/latest/meta-data/iam/security-credentials/node-role": `{
+			"Code": "Success",
+			"Type": "AWS-HMAC",
+			"AccessKeyId": "AKIDEXAMPLE",
+			"SecretAccessKey": "secret",
+			"Token": "session-token",
+			"Expiration": "` + expiration + `"
+		}`,
+	})
+	f.tokensRequired = true
+	c, done := newTestClient(f)
+	defer done()
+
+	p := &RoleProvider{Client: c}
+	creds, err := p.Retrieve()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.AccessKeyID != "AKIDEXAMPLE" || creds.SecretAccessKey != "secret" || creds.SessionToken != "session-token" {
+		t.Errorf("unexpected credentials: %+v", creds)
+	}
+	if p.IsExpired() {
+		t.Error("expected the credentials not to have expired")
+	}
+}
+
+func TestRoleProviderErrors(t *testing.T) {
+	f := newFakeIMDS(map[string]string{})
+	c, done := newTestClient(f)
+	defer done()
+
+	p := &RoleProvider{Client: c}
+	_, err := p.Retrieve()
+	if err == nil || err.Error() != "this instance doesn't have an IAM instance profile" {
+		t.Errorf("expected an error about the missing instance profile, got %v", err)
+	}
+
+	f.data = map[string]string{
+		"/latest/meta-data/iam/security-credentials/":          "node-role",
+		"/latest/meta-data/iam/security-credentials/node-role": `{"Code": "AssumeRoleUnauthorizedAccess", "Message": "not allowed"}`,
+	}
+	_, err = p.Retrieve()
+	if err == nil || err.Error() != "couldn't get credentials for the node-role role: AssumeRoleUnauthorizedAccess not allowed" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/errm/ekstrap/pkg/config"
+	"github.com/errm/ekstrap/pkg/imds"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// instanceMetadata is the part of the metadata service client that FromMetadata uses
+type instanceMetadata interface {
+	metadataClient
+	IdentityDocument(context.Context) (imds.IdentityDocument, error)
+}
+
+// FromMetadata returns a Node built only from the instance metadata service,
+// so unlike New it doesn't need to call the EC2 API, or have permission to.
+//
+// Tags are read from the metadata service if instance metadata tags are
+// enabled (InstanceMetadataTags=enabled). Tag keys containing a / can't be
+// used when they are, so the cluster name must be set in the config rather
+// than with the kubernetes.io/cluster/<name> tag.
+// If ctx is done while the metadata service is being retried, the reason from ctx is returned.
+func FromMetadata(ctx context.Context, m instanceMetadata, region *string, containerRuntime string, cfg config.Config) (*Node, error) {
+	if cfg.ClusterName == "" {
+		return nil, errors.New("the cluster name must be set in the config to discover facts from instance metadata, as the kubernetes.io/cluster/<name> tag can't be read from it")
+	}
+	doc, err := m.IdentityDocument(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := m.GetMetadata(ctx, "local-hostname")
+	if err != nil {
+		return nil, err
+	}
+	instance := &ec2.Instance{
+		InstanceId:       aws.String(doc.InstanceID),
+		InstanceType:     aws.String(doc.InstanceType),
+		Architecture:     aws.String(doc.Architecture),
+		PrivateIpAddress: aws.String(doc.PrivateIP),
+		PrivateDnsName:   aws.String(strings.TrimSpace(hostname)),
+		Placement:        &ec2.Placement{AvailabilityZone: aws.String(doc.AvailabilityZone)},
+	}
+
+	lifecycle, err := m.GetMetadata(ctx, "instance-life-cycle")
+	if err != nil && !imds.IsNotFound(err) {
+		return nil, err
+	}
+	// The metadata service reports on-demand, whereas EC2 leaves the lifecycle unset
+	if lifecycle != "" && lifecycle != "on-demand" {
+		instance.InstanceLifecycle = aws.String(lifecycle)
+	}
+
+	if instance.Tags, err = metadataTags(ctx, m); err != nil {
+		return nil, err
+	}
+
+	return &Node{
+		Instance:         instance,
+		Region:           *region,
+		ContainerRuntime: containerRuntime,
+		Config:           cfg,
+	}, nil
+}
+
+// metadataTags returns the instance's tags from the metadata service, or
+// none if instance metadata tags aren't enabled.
+func metadataTags(ctx context.Context, m metadataClient) ([]*ec2.Tag, error) {
+	keys, err := m.GetMetadata(ctx, "tags/instance")
+	if imds.IsNotFound(err) {
+		log.Print("Instance tags aren't available from the instance metadata service, as InstanceMetadataTags isn't enabled")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tags []*ec2.Tag
+	for _, key := range strings.Split(keys, "\n") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		value, err := m.GetMetadata(ctx, "tags/instance/"+key)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return tags, nil
+}
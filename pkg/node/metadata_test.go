@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/errm/ekstrap/pkg/config"
+	"github.com/errm/ekstrap/pkg/imds"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const identityDocument = `{
+	"instanceId": "i-1234",
+	"instanceType": "c5.large",
+	"region": "us-east-1",
+	"availabilityZone": "us-east-1a",
+	"architecture": "arm64",
+	"privateIp": "10.0.1.2"
+}`
+
+func metadataServer(data map[string]string) (*imds.Client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			// Only IMDSv1 is supported
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		value, ok := data[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, value)
+	}))
+	return &imds.Client{Endpoint: server.URL, HTTPClient: server.Client()}, server.Close
+}
+
+func TestFromMetadata(t *testing.T) {
+	metadata, done := metadataServer(map[string]string{
+		"/latest/dynamic/instance-identity/document": identityDocument,
+		"/latest/meta-data/local-hostname":           "ip-10-0-1-2.ec2.internal",
+		"/latest/meta-data/instance-life-cycle":      "spot",
+		"/latest/meta-data/tags/instance":            "Name\nteam",
+		"/latest/meta-data/tags/instance/Name":       "worker",
+		"/latest/meta-data/tags/instance/team":       "platform",
+	})
+	defer done()
+
+	node, err := FromMetadata(context.Background(), metadata, &use1, "containerd", config.Config{ClusterName: "cluster-name"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if aws.StringValue(node.InstanceId) != "i-1234" {
+		t.Errorf("expected instance id i-1234, got %s", aws.StringValue(node.InstanceId))
+	}
+	if aws.StringValue(node.PrivateDnsName) != "ip-10-0-1-2.ec2.internal" {
+		t.Errorf("expected private DNS name ip-10-0-1-2.ec2.internal, got %s", aws.StringValue(node.PrivateDnsName))
+	}
+	if node.ClusterName() != "cluster-name" {
+		t.Errorf("expected cluster name cluster-name, got %s", node.ClusterName())
+	}
+	if !node.Spot() {
+		t.Error("expected a spot instance")
+	}
+	if node.ContainerArchitecture() != "arm64" {
+		t.Errorf("expected arm64, got %s", node.ContainerArchitecture())
+	}
+	if node.MaxPods() != 27 {
+		t.Errorf("expected 27 max pods, got %d", node.MaxPods())
+	}
+	if node.ClusterDNS() != "172.20.0.10" {
+		t.Errorf("expected 172.20.0.10, got %s", node.ClusterDNS())
+	}
+	expected := map[string]string{"Name": "worker", "team": "platform"}
+	tags := make(map[string]string)
+	for _, t := range node.Tags {
+		tags[*t.Key] = *t.Value
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+}
+
+func TestFromMetadataWithoutTags(t *testing.T) {
+	metadata, done := metadataServer(map[string]string{
+		"/latest/dynamic/instance-identity/document": identityDocument,
+		"/latest/meta-data/local-hostname":           "ip-10-0-1-2.ec2.internal",
+		"/latest/meta-data/instance-life-cycle":      "on-demand",
+	})
+	defer done()
+
+	node, err := FromMetadata(context.Background(), metadata, &use1, "containerd", config.Config{ClusterName: "cluster-name"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node.Spot() {
+		t.Error("expected an on-demand instance")
+	}
+	if node.InstanceLifecycle != nil {
+		t.Errorf("expected the lifecycle to be unset like it is from EC2, got %s", *node.InstanceLifecycle)
+	}
+	if len(node.Tags) != 0 {
+		t.Errorf("expected no tags, got %v", node.Tags)
+	}
+}
+
+func TestFromMetadataErrors(t *testing.T) {
+	metadata, done := metadataServer(map[string]string{})
+	defer done()
+
+	if _, err := FromMetadata(context.Background(), metadata, &use1, "containerd", config.Config{}); err == nil {
+		t.Error("expected an error when the cluster name isn't configured")
+	}
+	if _, err := FromMetadata(context.Background(), metadata, &use1, "containerd", config.Config{ClusterName: "cluster-name"}); !imds.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
@@ -18,15 +18,17 @@ package node
 
 import (
 	"github.com/errm/ekstrap/pkg/backoff"
+	"github.com/errm/ekstrap/pkg/config"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 
+	"context"
 	"fmt"
 	"log"
 	"regexp"
 	"sort"
-	"time"
 )
 
 const (
@@ -44,43 +46,71 @@ const (
 )
 
 // Node represents and EC2 instance.
+//
+// Any values set in Config override those we would otherwise work out
+// from the instance.
 type Node struct {
 	*ec2.Instance
 	Region           string
 	ContainerRuntime string
+	// KubeletVersion is the version of the installed kubelet e.g. v1.27.3
+	KubeletVersion string
+	Config         config.Config
 }
 
 type metadataClient interface {
-	GetMetadata(string) (string, error)
+	GetMetadata(context.Context, string) (string, error)
 }
 
 var b = backoff.Backoff{Seq: []int{1, 1, 2}}
 
 // New returns a Node instance.
 //
-// If the EC2 instance doesn't have the expected kubernetes tag, it will backoff and retry.
+// If the EC2 instance doesn't have the expected kubernetes tag, (and the cluster name isn't
+// set in the config) it will backoff and retry.
+// If EC2 doesn't know about the instance yet (as can happen just after launch) or the
+// request is throttled it will also backoff and retry.
 // If it isn't able to query EC2 or there are any other errors, an error will be returned.
-func New(e ec2iface.EC2API, m metadataClient, region *string, containerRuntime string) (*Node, error) {
-	id, err := instanceID(m)
+// If ctx is done before the tag is set, the reason from ctx is returned.
+func New(ctx context.Context, e ec2iface.EC2API, m metadataClient, region *string, containerRuntime string, cfg config.Config) (*Node, error) {
+	id, err := instanceID(ctx, m)
 	if err != nil {
 		return nil, err
 	}
 	tries := 1
 	for {
-		output, err := e.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: []*string{id}})
+		output, err := e.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: []*string{id}})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			if reason := retryReason(err); reason != "" {
+				sleepFor := b.Duration(tries)
+				log.Printf("%s, will try again in %s", reason, sleepFor)
+				if err := backoff.Wait(ctx, sleepFor); err != nil {
+					return nil, err
+				}
+				tries++
+				continue
+			}
+			return nil, err
+		}
+		instance, err := findInstance(output, *id)
 		if err != nil {
 			return nil, err
 		}
-		instance := output.Reservations[0].Instances[0]
 		node := Node{
 			Instance:         instance,
 			Region:           *region,
 			ContainerRuntime: containerRuntime,
+			Config:           cfg,
 		}
 		if node.ClusterName() == "" {
 			sleepFor := b.Duration(tries)
 			log.Printf("The kubernetes.io/cluster/<name> tag is not yet set, will try again in %s", sleepFor)
-			time.Sleep(sleepFor)
+			if err := backoff.Wait(ctx, sleepFor); err != nil {
+				return nil, err
+			}
 			tries++
 			continue
 		}
@@ -88,10 +118,48 @@ func New(e ec2iface.EC2API, m metadataClient, region *string, containerRuntime s
 	}
 }
 
+// retryReason returns a description of err if it is worth retrying the
+// DescribeInstances request that caused it, or "" if it isn't.
+func retryReason(err error) string {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return ""
+	}
+	switch aerr.Code() {
+	case "InvalidInstanceID.NotFound":
+		// EC2 is eventually consistent, so a newly launched instance
+		// might not be visible to the API for a little while
+		return "EC2 doesn't know about this instance yet"
+	case "RequestLimitExceeded", "Throttling", "ThrottlingException":
+		return "Requests to the EC2 API are being throttled"
+	}
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return fmt.Sprintf("The EC2 API is currently unavailable (%s)", aerr.Code())
+	}
+	return ""
+}
+
+// findInstance returns the instance with the given id from a DescribeInstances response
+func findInstance(output *ec2.DescribeInstancesOutput, id string) (*ec2.Instance, error) {
+	if output != nil {
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance != nil {
+					return instance, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("EC2 didn't return any details for the instance %s, even though the request succeeded", id)
+}
+
 // ClusterName returns the cluster name.
 //
-// It reads the cluster name from a tag on the EC2 instance.
+// It reads the cluster name from a tag on the EC2 instance, unless it is set in the config.
 func (n *Node) ClusterName() string {
+	if n.Config.ClusterName != "" {
+		return n.Config.ClusterName
+	}
 	re := regexp.MustCompile(`kubernetes.io\/cluster\/([\w-]+)`)
 	for _, t := range n.Tags {
 		if matches := re.FindStringSubmatch(*t.Key); len(matches) == 2 {
@@ -104,16 +172,22 @@ func (n *Node) ClusterName() string {
 // Labels returns list of kubernetes labels for this node
 //
 // If the node is a spot instance the node-role.kubernetes.io/spot-worker label
-// will be set, otherwise the node-role.kubernetes.io/worker is set.
+// will be set, otherwise the node-role.kubernetes.io/worker is set. From 1.16
+// the kubelet refuses to set labels in the node-role.kubernetes.io namespace,
+// so node.kubernetes.io/spot-worker or node.kubernetes.io/worker is set instead.
 //
 // Other custom labels can be set using EC2 tags with the k8s.io/cluster-autoscaler/node-template/label/ prefix
 func (n *Node) Labels() []string {
 	labels := make(map[string]string)
 
+	prefix := "node.kubernetes.io/"
+	if n.kubeletBefore(minorVersion{1, 16}) {
+		prefix = "node-role.kubernetes.io/"
+	}
 	if n.Spot() {
-		labels["node-role.kubernetes.io/spot-worker"] = "true"
+		labels[prefix+"spot-worker"] = "true"
 	} else {
-		labels["node-role.kubernetes.io/worker"] = "true"
+		labels[prefix+"worker"] = "true"
 	}
 
 	re := regexp.MustCompile(`k8s.io\/cluster-autoscaler\/node-template\/label\/(.*)`)
@@ -154,8 +228,8 @@ func (n *Node) Taints() []string {
 	return taints
 }
 
-func instanceID(m metadataClient) (*string, error) {
-	result, err := m.GetMetadata("instance-id")
+func instanceID(ctx context.Context, m metadataClient) (*string, error) {
+	result, err := m.GetMetadata(ctx, "instance-id")
 	if err != nil {
 		return nil, err
 	}
@@ -166,6 +240,9 @@ func instanceID(m metadataClient) (*string, error) {
 //
 // see https://github.com/aws/amazon-vpc-cni-k8s#setup for more info
 func (n *Node) MaxPods() int {
+	if n.Config.MaxPods > 0 {
+		return n.Config.MaxPods
+	}
 	enis := InstanceENIsAvailable[*n.InstanceType]
 	ips := InstanceIPsAvailable[*n.InstanceType]
 	if ips == 0 {
@@ -180,6 +257,9 @@ func (n *Node) MaxPods() int {
 // here: https://cloud.google.com/kubernetes-engine/docs/concepts/cluster-architecture
 // I think that it should also apply to AWS
 func (n *Node) ReservedCPU() string {
+	if n.Config.KubeReserved.CPU != "" {
+		return n.Config.KubeReserved.CPU
+	}
 	cores := InstanceCores[*n.InstanceType]
 	reserved := 0.0
 	for core := 1; core <= cores; core++ {
@@ -207,6 +287,9 @@ func (n *Node) ReservedCPU() string {
 // here: https://cloud.google.com/kubernetes-engine/docs/concepts/cluster-architecture
 // I think that it should also apply to AWS
 func (n *Node) ReservedMemory() string {
+	if n.Config.KubeReserved.Memory != "" {
+		return n.Config.KubeReserved.Memory
+	}
 	memory := InstanceMemory[*n.InstanceType]
 	reserved := 0.0
 	for i := 0; i < memory; i++ {
@@ -232,6 +315,9 @@ func (n *Node) ReservedMemory() string {
 
 // ClusterDNS returns the in cluster IP address that kube-dns should avalible at
 func (n *Node) ClusterDNS() string {
+	if n.Config.ClusterDNS != "" {
+		return n.Config.ClusterDNS
+	}
 	if n.PrivateIpAddress != nil && len(*n.PrivateIpAddress) > 3 && (*n.PrivateIpAddress)[0:3] == "10." {
 		return "172.20.0.10"
 	}
@@ -259,8 +345,108 @@ func (n *Node) ContainerArchitecture() string {
 	return "amd64"
 }
 
+// RuntimeEndpoint returns the CRI socket of the container runtime, docker
+// doesn't have one as the kubelet talks to it with the built in dockershim
+func (n *Node) RuntimeEndpoint() string {
+	switch n.ContainerRuntime {
+	case "containerd":
+		return "unix:///run/containerd/containerd.sock"
+	case "crio":
+		return "unix:///var/run/crio/crio.sock"
+	default:
+		return ""
+	}
+}
+
+// EvictionHard returns the thresholds at which the kubelet should evict pods
+//
+// Any signals set in the config replace our defaults, the rest are left as they are.
+func (n *Node) EvictionHard() map[string]string {
+	thresholds := map[string]string{
+		"memory.available":  "100Mi",
+		"nodefs.available":  "10%",
+		"nodefs.inodesFree": "5%",
+	}
+	for signal, threshold := range n.Config.EvictionHard {
+		thresholds[signal] = threshold
+	}
+	return thresholds
+}
+
+// CgroupDriver returns the cgroup driver that the kubelet and the container
+// runtime should both use, cgroupfs unless it is set in the config
+func (n *Node) CgroupDriver() string {
+	if n.Config.CgroupDriver != "" {
+		return n.Config.CgroupDriver
+	}
+	return "cgroupfs"
+}
+
+// RegistryMirrors returns the endpoints the container runtime should pull
+// images from instead of each registry, from the config
+func (n *Node) RegistryMirrors() map[string][]string {
+	return n.Config.RegistryMirrors
+}
+
+// DefaultEkstrapPath is where the README suggests installing ekstrap
+const DefaultEkstrapPath = "/usr/sbin/ekstrap"
+
+// EkstrapPath returns the path that the kubelet should run ekstrap from to get
+// a token, DefaultEkstrapPath unless it is set in the config.
+//
+// It doesn't depend on where the running binary is, so that rendering the
+// config somewhere else, or from a snapshot, gives the same kubeconfig.
+func (n *Node) EkstrapPath() string {
+	if n.Config.EkstrapPath != "" {
+		return n.Config.EkstrapPath
+	}
+	return DefaultEkstrapPath
+}
+
+// InsecureRegistries returns the registries that docker can pull images from
+// without verifying TLS, from the config
+func (n *Node) InsecureRegistries() []string {
+	return n.Config.InsecureRegistries
+}
+
 // PauseImage returns the image name of the Pause image provided by AWS
 // to use as the `pod-infra-container-image`
+//
+// By default the repository for the node's architecture is used e.g. eks/pause-arm64,
+// if pauseImageMultiArch is set in the config the multi-arch eks/pause repository is used instead.
 func (n *Node) PauseImage() string {
-	return n.EKSResourceAccount() + ".dkr.ecr." + n.Region + ".amazonaws.com/eks/pause-" + n.ContainerArchitecture() + ":3.1"
+	if n.Config.PauseImage != "" {
+		return n.Config.PauseImage
+	}
+	repository := "pause-" + n.ContainerArchitecture()
+	if n.Config.PauseImageMultiArch {
+		repository = "pause"
+	}
+	return n.EKSResourceAccount() + ".dkr.ecr." + n.Region + ".amazonaws.com/eks/" + repository + ":" + n.PauseImageTag()
+}
+
+// pauseImageTags are the pause image tags used by the EKS AMIs, from the
+// Kubernetes version that they were first used with.
+var pauseImageTags = []struct {
+	since minorVersion
+	tag   string
+}{
+	{since: minorVersion{1, 22}, tag: "3.5"},
+	{since: minorVersion{1, 0}, tag: "3.1"},
+}
+
+// PauseImageTag returns the tag of the pause image for the version of the kubelet,
+// unless it is set in the config. If the kubelet's version is unknown 3.1 is used.
+func (n *Node) PauseImageTag() string {
+	if n.Config.PauseImageTag != "" {
+		return n.Config.PauseImageTag
+	}
+	if version, ok := parseVersion(n.Version()); ok {
+		for _, t := range pauseImageTags {
+			if !version.before(t.since) {
+				return t.tag
+			}
+		}
+	}
+	return "3.1"
 }
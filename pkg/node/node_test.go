@@ -17,13 +17,20 @@ limitations under the License.
 package node
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/errm/ekstrap/pkg/backoff"
+	"github.com/errm/ekstrap/pkg/config"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
@@ -50,7 +57,7 @@ func TestNewNode(t *testing.T) {
 			"instance-id": "1234",
 		},
 	}
-	node, err := New(e, metadata, &use1, "docker")
+	node, err := New(context.Background(), e, metadata, &use1, "docker", config.Config{})
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -68,6 +75,147 @@ func TestNewNode(t *testing.T) {
 	}
 }
 
+func TestNewNodeClusterNameFromConfig(t *testing.T) {
+	disableBackoff()
+	e := &mockEC2{
+		tags: [][]*ec2.Tag{
+			{},
+		},
+	}
+	metadata := mockMetadata{
+		data: map[string]string{
+			"instance-id": "1234",
+		},
+	}
+	node, err := New(context.Background(), e, metadata, &use1, "docker", config.Config{ClusterName: "configured"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if node.ClusterName() != "configured" {
+		t.Errorf("Expected returned node to have the configured cluster name, got %s", node.ClusterName())
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	instanceType := "c5.large"
+	ip := "10.1.123.4"
+	arch := "x86_64"
+	instance := &ec2.Instance{
+		InstanceType:     &instanceType,
+		PrivateIpAddress: &ip,
+		Architecture:     &arch,
+		Tags:             []*ec2.Tag{tag("kubernetes.io/cluster/cluster-name", "owned")},
+	}
+
+	defaults := Node{Instance: instance, Region: use1}
+	overridden := Node{Instance: instance, Region: use1, Config: config.Config{
+		ClusterName:  "other-cluster",
+		ClusterDNS:   "10.100.0.10",
+		MaxPods:      110,
+		KubeReserved: config.Reserved{CPU: "250m", Memory: "2Gi"},
+		EvictionHard: map[string]string{"memory.available": "500Mi", "pid.available": "10%"},
+		PauseImage:   "registry.example.com/pause:3.9",
+		CgroupDriver: "systemd",
+	}}
+
+	tests := []struct {
+		desc     string
+		actual   func(Node) interface{}
+		computed interface{}
+		override interface{}
+	}{
+		{
+			desc:     "ClusterName",
+			actual:   func(n Node) interface{} { return n.ClusterName() },
+			computed: "cluster-name",
+			override: "other-cluster",
+		},
+		{
+			desc:     "ClusterDNS",
+			actual:   func(n Node) interface{} { return n.ClusterDNS() },
+			computed: "172.20.0.10",
+			override: "10.100.0.10",
+		},
+		{
+			desc:     "MaxPods",
+			actual:   func(n Node) interface{} { return n.MaxPods() },
+			computed: 27,
+			override: 110,
+		},
+		{
+			desc:     "ReservedCPU",
+			actual:   func(n Node) interface{} { return n.ReservedCPU() },
+			computed: "70m",
+			override: "250m",
+		},
+		{
+			desc:     "ReservedMemory",
+			actual:   func(n Node) interface{} { return n.ReservedMemory() },
+			computed: "1024Mi",
+			override: "2Gi",
+		},
+		{
+			desc:   "EvictionHard",
+			actual: func(n Node) interface{} { return n.EvictionHard() },
+			computed: map[string]string{
+				"memory.available":  "100Mi",
+				"nodefs.available":  "10%",
+				"nodefs.inodesFree": "5%",
+			},
+			override: map[string]string{
+				"memory.available":  "500Mi",
+				"nodefs.available":  "10%",
+				"nodefs.inodesFree": "5%",
+				"pid.available":     "10%",
+			},
+		},
+		{
+			desc:     "PauseImage",
+			actual:   func(n Node) interface{} { return n.PauseImage() },
+			computed: "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-amd64:3.1",
+			override: "registry.example.com/pause:3.9",
+		},
+		{
+			desc:     "CgroupDriver",
+			actual:   func(n Node) interface{} { return n.CgroupDriver() },
+			computed: "cgroupfs",
+			override: "systemd",
+		},
+	}
+
+	for _, test := range tests {
+		if actual := test.actual(defaults); !reflect.DeepEqual(actual, test.computed) {
+			t.Errorf("expected computed %s to be %v, got %v", test.desc, test.computed, actual)
+		}
+		if actual := test.actual(overridden); !reflect.DeepEqual(actual, test.override) {
+			t.Errorf("expected overridden %s to be %v, got %v", test.desc, test.override, actual)
+		}
+	}
+}
+
+func TestNewNodeContext(t *testing.T) {
+	b = backoff.Backoff{Seq: []int{60}}
+	defer disableBackoff()
+
+	e := &mockEC2{
+		tags: [][]*ec2.Tag{
+			{},
+		},
+	}
+	metadata := mockMetadata{
+		data: map[string]string{
+			"instance-id": "1234",
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := New(ctx, e, metadata, &use1, "docker", config.Config{})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected error: %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
 func TestNodeLabels(t *testing.T) {
 	disableBackoff()
 	e := &mockEC2{
@@ -85,7 +233,7 @@ func TestNodeLabels(t *testing.T) {
 			"instance-id": "1234",
 		},
 	}
-	node, err := New(e, metadata, &use1, "docker")
+	node, err := New(context.Background(), e, metadata, &use1, "docker", config.Config{})
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -110,7 +258,7 @@ func TestNodeLabels(t *testing.T) {
 		},
 		instanceLifecycle: ec2.InstanceLifecycleTypeSpot,
 	}
-	node, err = New(e, metadata, &use1, "docker")
+	node, err = New(context.Background(), e, metadata, &use1, "docker", config.Config{})
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -123,6 +271,17 @@ func TestNodeLabels(t *testing.T) {
 	if !reflect.DeepEqual(node.Labels(), expected) {
 		t.Errorf("Expected node.Labels to be %v but was %v", expected, node.Labels())
 	}
+
+	// From 1.16 the kubelet won't set labels in the node-role.kubernetes.io namespace
+	node.KubeletVersion = "v1.16.15"
+	expected = []string{
+		"node.kubernetes.io/spot-worker=true",
+		"nvidia-gpu=K80",
+	}
+
+	if !reflect.DeepEqual(node.Labels(), expected) {
+		t.Errorf("Expected node.Labels to be %v but was %v", expected, node.Labels())
+	}
 }
 
 func TestNodeTaints(t *testing.T) {
@@ -144,7 +303,7 @@ func TestNodeTaints(t *testing.T) {
 			"instance-id": "1234",
 		},
 	}
-	node, err := New(e, metadata, &use1, "docker")
+	node, err := New(context.Background(), e, metadata, &use1, "docker", config.Config{})
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -165,7 +324,7 @@ func TestClusterDNS(t *testing.T) {
 			{tag("kubernetes.io/cluster/cluster-name", "owned")},
 		},
 	}
-	node, err := New(e, mockMetadata{}, &use1, "docker")
+	node, err := New(context.Background(), e, mockMetadata{}, &use1, "docker", config.Config{})
 
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
@@ -181,7 +340,7 @@ func TestClusterDNS(t *testing.T) {
 			{tag("kubernetes.io/cluster/cluster-name", "owned")},
 		},
 	}
-	node, err = New(e, mockMetadata{}, &use1, "docker")
+	node, err = New(context.Background(), e, mockMetadata{}, &use1, "docker", config.Config{})
 
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
@@ -199,7 +358,7 @@ func TestNewErrors(t *testing.T) {
 	e := &mockEC2{err: ec2Error}
 	metadata := mockMetadata{err: metadataError}
 
-	_, err := New(e, metadata, &use1, "docker")
+	_, err := New(context.Background(), e, metadata, &use1, "docker", config.Config{})
 	if err != metadataError {
 		t.Errorf("expected error: %s to be %s", err, metadataError)
 	}
@@ -210,12 +369,55 @@ func TestNewErrors(t *testing.T) {
 		},
 	}
 
-	_, err = New(e, metadata, &use1, "docker")
+	_, err = New(context.Background(), e, metadata, &use1, "docker", config.Config{})
 	if err != ec2Error {
 		t.Errorf("expected error: %s to be %s", err, ec2Error)
 	}
 }
 
+func TestNewRetries(t *testing.T) {
+	disableBackoff()
+	metadata := mockMetadata{
+		data: map[string]string{
+			"instance-id": "1234",
+		},
+	}
+	notFound := awserr.New("InvalidInstanceID.NotFound", "The instance ID '1234' does not exist", nil)
+	throttled := awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+	unavailable := awserr.NewRequestFailure(awserr.New("Unavailable", "The service is unavailable", nil), 503, "request-id")
+	denied := awserr.NewRequestFailure(awserr.New("UnauthorizedOperation", "You are not authorized", nil), 403, "request-id")
+
+	e := &mockEC2{
+		errs: []error{notFound, notFound, throttled, unavailable},
+		tags: [][]*ec2.Tag{{tag("kubernetes.io/cluster/cluster-name", "owned")}},
+	}
+	node, err := New(context.Background(), e, metadata, &use1, "docker", config.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if node.ClusterName() != "cluster-name" {
+		t.Errorf("Expected returned node to have cluster-name, got %s", node.ClusterName())
+	}
+	if e.calls != 5 {
+		t.Errorf("expected 5 calls to DescribeInstances, got %d", e.calls)
+	}
+
+	e = &mockEC2{errs: []error{denied}}
+	_, err = New(context.Background(), e, metadata, &use1, "docker", config.Config{})
+	if err != denied {
+		t.Errorf("expected error: %s to be %s", err, denied)
+	}
+	if e.calls != 1 {
+		t.Errorf("expected errors that aren't transient not to be retried, got %d calls", e.calls)
+	}
+
+	e = &mockEC2{empty: true}
+	_, err = New(context.Background(), e, metadata, &use1, "docker", config.Config{})
+	if err == nil || !strings.Contains(err.Error(), "didn't return any details for the instance 1234") {
+		t.Errorf("expected a descriptive error for an empty response, got %v", err)
+	}
+}
+
 func TestClusterName(t *testing.T) {
 	tests := []struct {
 		node     Node
@@ -255,6 +457,31 @@ func TestClusterName(t *testing.T) {
 	}
 }
 
+func TestRuntimeEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"containerd": "unix:///run/containerd/containerd.sock",
+		"crio":       "unix:///var/run/crio/crio.sock",
+		"docker":     "",
+	}
+	for runtime, expected := range tests {
+		n := Node{ContainerRuntime: runtime}
+		if actual := n.RuntimeEndpoint(); actual != expected {
+			t.Errorf("expected the endpoint for %s to be %q, got %q", runtime, expected, actual)
+		}
+	}
+}
+
+func TestEkstrapPath(t *testing.T) {
+	if actual := (&Node{}).EkstrapPath(); actual != "/usr/sbin/ekstrap" {
+		t.Errorf("expected /usr/sbin/ekstrap by default, got %s", actual)
+	}
+
+	n := Node{Config: config.Config{EkstrapPath: "/opt/bin/ekstrap"}}
+	if actual := n.EkstrapPath(); actual != "/opt/bin/ekstrap" {
+		t.Errorf("expected the path from the config, got %s", actual)
+	}
+}
+
 func TestPauseImage(t *testing.T) {
 	arm := "arm64"
 	amd := "x86_64"
@@ -282,6 +509,26 @@ func TestPauseImage(t *testing.T) {
 			node:     Node{Region: "us-east-1", Instance: &ec2.Instance{Architecture: &arm}},
 			expected: "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-arm64:3.1",
 		},
+		{
+			node:     Node{Region: "us-east-1", Instance: &ec2.Instance{Architecture: &arm}, KubeletVersion: "v1.21.14"},
+			expected: "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-arm64:3.1",
+		},
+		{
+			node:     Node{Region: "us-east-1", Instance: &ec2.Instance{Architecture: &arm}, KubeletVersion: "v1.27.3"},
+			expected: "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-arm64:3.5",
+		},
+		{
+			node:     Node{Region: "us-east-1", Instance: &ec2.Instance{Architecture: &arm}, Config: config.Config{KubeletVersion: "1.22"}},
+			expected: "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-arm64:3.5",
+		},
+		{
+			node:     Node{Region: "us-east-1", Instance: &ec2.Instance{Architecture: &amd}, KubeletVersion: "v1.27.3", Config: config.Config{PauseImageTag: "3.9"}},
+			expected: "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-amd64:3.9",
+		},
+		{
+			node:     Node{Region: "us-east-1", Instance: &ec2.Instance{Architecture: &arm}, KubeletVersion: "v1.27.3", Config: config.Config{PauseImageMultiArch: true}},
+			expected: "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause:3.5",
+		},
 	}
 
 	for _, test := range tests {
@@ -331,7 +578,7 @@ func TestMaxPods(t *testing.T) {
 				"instance-id": "1234",
 			},
 		}
-		node, err := New(e, metadata, &usw2, "docker")
+		node, err := New(context.Background(), e, metadata, &usw2, "docker", config.Config{})
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
@@ -406,7 +653,7 @@ func TestReservedCPU(t *testing.T) {
 				"instance-id": "1234",
 			},
 		}
-		node, err := New(e, metadata, &usw2, "docker")
+		node, err := New(context.Background(), e, metadata, &usw2, "docker", config.Config{})
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
@@ -476,7 +723,7 @@ func TestMemory(t *testing.T) {
 				"instance-id": "1234",
 			},
 		}
-		node, err := New(e, metadata, &usw2, "docker")
+		node, err := New(context.Background(), e, metadata, &usw2, "docker", config.Config{})
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
@@ -560,12 +807,26 @@ type mockEC2 struct {
 	instanceType      string
 	instanceLifecycle string
 	err               error
+	// errs are returned, one per call, before any tags are returned
+	errs []error
+	// empty returns a response with no reservations
+	empty bool
+	calls int
 }
 
-func (m *mockEC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+func (m *mockEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	m.calls++
 	if m.err != nil {
 		return nil, m.err
 	}
+	if len(m.errs) > 0 {
+		var err error
+		err, m.errs = m.errs[0], m.errs[1:]
+		return nil, err
+	}
+	if m.empty {
+		return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{}}, nil
+	}
 	var tags []*ec2.Tag
 	//Pop the first set of tags
 	tags, m.tags = m.tags[0], m.tags[1:]
@@ -598,7 +859,7 @@ type mockMetadata struct {
 	err  error
 }
 
-func (m mockMetadata) GetMetadata(key string) (string, error) {
+func (m mockMetadata) GetMetadata(ctx context.Context, key string) (string, error) {
 	if m.err != nil {
 		return "", m.err
 	}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+var versionRE = regexp.MustCompile(`v?(\d+)\.(\d+)`)
+
+// minorVersion is a Kubernetes version, ignoring the patch release
+type minorVersion struct {
+	major, minor int
+}
+
+// parseVersion parses versions like 1.27, v1.27.3 or v1.27.3-eks-a5565ad
+func parseVersion(version string) (minorVersion, bool) {
+	matches := versionRE.FindStringSubmatch(version)
+	if matches == nil {
+		return minorVersion{}, false
+	}
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	return minorVersion{major: major, minor: minor}, true
+}
+
+func (v minorVersion) before(other minorVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	return v.minor < other.minor
+}
+
+func (v minorVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// Version returns the version of the kubelet that we are configuring.
+//
+// It is the version set in the config, or if that is unset the version that
+// was detected, it is empty if neither is known.
+func (n *Node) Version() string {
+	if n.Config.KubeletVersion != "" {
+		return n.Config.KubeletVersion
+	}
+	return n.KubeletVersion
+}
+
+// KubeletBefore returns true if the kubelet is older than version e.g. 1.24.
+//
+// If the kubelet's version is unknown it also returns true, so that we keep
+// using the flags and config that older versions of ekstrap always used.
+// It is used in templates, so an invalid version is an error rather than a panic.
+func (n *Node) KubeletBefore(version string) (bool, error) {
+	v, ok := parseVersion(version)
+	if !ok {
+		return false, fmt.Errorf("invalid version: %q", version)
+	}
+	return n.kubeletBefore(v), nil
+}
+
+func (n *Node) kubeletBefore(version minorVersion) bool {
+	kubelet, ok := parseVersion(n.Version())
+	return !ok || kubelet.before(version)
+}
+
+// VersionWarnings returns a warning for each problem with the kubelet's
+// version, given the version of the cluster's control plane.
+//
+// see https://kubernetes.io/releases/version-skew-policy/#kubelet
+func (n *Node) VersionWarnings(clusterVersion string) []string {
+	kubelet, ok := parseVersion(n.Version())
+	if !ok {
+		return []string{"The version of the kubelet is unknown, so it will be configured with the flags that older versions of Kubernetes need"}
+	}
+	var warnings []string
+	if cluster, ok := parseVersion(clusterVersion); ok {
+		// Since 1.28 the kubelet may be 3 minor versions older than the control plane
+		skew := 2
+		if !cluster.before(minorVersion{1, 28}) {
+			skew = 3
+		}
+		switch {
+		case cluster.before(kubelet):
+			warnings = append(warnings, fmt.Sprintf("The kubelet (%s) is newer than the EKS control plane (%s), which is not supported", kubelet, cluster))
+		case kubelet.major == cluster.major && cluster.minor-kubelet.minor > skew:
+			warnings = append(warnings, fmt.Sprintf("The kubelet (%s) is more than %d minor versions older than the EKS control plane (%s), which is not supported", kubelet, skew, cluster))
+		}
+	}
+	if n.ContainerRuntime == "docker" && !kubelet.before(minorVersion{1, 24}) {
+		warnings = append(warnings, fmt.Sprintf("The kubelet (%s) can't use docker as its container runtime, as dockershim was removed in 1.24", kubelet))
+	}
+	return warnings
+}
+
+// ExecAPIVersion returns the client.authentication.k8s.io API version that the
+// kubelet should use to run its exec credential plugin, unless it is set in the config.
+//
+// v1 is used from 1.22 and v1beta1 from 1.11, if the kubelet's version is
+// unknown v1alpha1 is used, as older versions of ekstrap always did.
+func (n *Node) ExecAPIVersion() string {
+	version := n.Config.ExecAPIVersion
+	if version == "" {
+		switch {
+		case !n.kubeletBefore(minorVersion{1, 22}):
+			version = "v1"
+		case !n.kubeletBefore(minorVersion{1, 11}):
+			version = "v1beta1"
+		default:
+			version = "v1alpha1"
+		}
+	}
+	return "client.authentication.k8s.io/" + version
+}
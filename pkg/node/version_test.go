@@ -0,0 +1,154 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/errm/ekstrap/pkg/config"
+)
+
+func TestKubeletBefore(t *testing.T) {
+	testCases := []struct {
+		kubelet  string
+		config   string
+		version  string
+		expected bool
+	}{
+		{kubelet: "v1.14.9", version: "1.15", expected: true},
+		{kubelet: "v1.15.0", version: "1.15", expected: false},
+		{kubelet: "v1.27.3-eks-a5565ad", version: "1.24", expected: false},
+		{kubelet: "v1.9.11", version: "1.10", expected: true},
+		{kubelet: "v2.0.0", version: "1.30", expected: false},
+		{kubelet: "v1.27.3", config: "1.23", version: "1.24", expected: true},
+		{kubelet: "", version: "1.15", expected: true},
+		{kubelet: "unknown", version: "1.27", expected: true},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.kubelet+"<"+tC.version, func(t *testing.T) {
+			n := Node{KubeletVersion: tC.kubelet, Config: config.Config{KubeletVersion: tC.config}}
+			actual, err := n.KubeletBefore(tC.version)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != tC.expected {
+				t.Errorf("expected %t, got %t", tC.expected, actual)
+			}
+		})
+	}
+
+	for _, kubelet := range []string{"v1.27.3", ""} {
+		n := Node{KubeletVersion: kubelet}
+		if _, err := n.KubeletBefore("latest"); err == nil || err.Error() != `invalid version: "latest"` {
+			t.Errorf("expected an error for an invalid version, got %v", err)
+		}
+	}
+}
+
+func TestVersionWarnings(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		kubelet  string
+		cluster  string
+		runtime  string
+		expected []string
+	}{
+		{desc: "same version", kubelet: "v1.27.3", cluster: "1.27", runtime: "containerd"},
+		{desc: "supported skew", kubelet: "v1.25.1", cluster: "1.27", runtime: "containerd"},
+		{desc: "supported skew since 1.28", kubelet: "v1.25.1", cluster: "1.28", runtime: "containerd"},
+		{desc: "unknown cluster version", kubelet: "v1.25.1", runtime: "containerd"},
+		{
+			desc:     "unknown kubelet version",
+			cluster:  "1.27",
+			runtime:  "containerd",
+			expected: []string{"The version of the kubelet is unknown"},
+		},
+		{
+			desc:     "kubelet newer than the control plane",
+			kubelet:  "v1.28.1",
+			cluster:  "1.27",
+			runtime:  "containerd",
+			expected: []string{"The kubelet (1.28) is newer than the EKS control plane (1.27)"},
+		},
+		{
+			desc:     "kubelet too old",
+			kubelet:  "v1.24.1",
+			cluster:  "1.27",
+			runtime:  "containerd",
+			expected: []string{"The kubelet (1.24) is more than 2 minor versions older than the EKS control plane (1.27)"},
+		},
+		{
+			desc:     "docker",
+			kubelet:  "v1.24.1",
+			cluster:  "1.24",
+			runtime:  "docker",
+			expected: []string{"dockershim was removed in 1.24"},
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			n := Node{KubeletVersion: tC.kubelet, ContainerRuntime: tC.runtime}
+			warnings := n.VersionWarnings(tC.cluster)
+			if len(warnings) != len(tC.expected) {
+				t.Fatalf("expected %d warnings, got %v", len(tC.expected), warnings)
+			}
+			for i, warning := range warnings {
+				if !strings.Contains(warning, tC.expected[i]) {
+					t.Errorf("expected warning to contain %q, got %q", tC.expected[i], warning)
+				}
+			}
+		})
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	v, ok := parseVersion("Kubernetes v1.27.3-eks-a5565ad")
+	if !ok || !reflect.DeepEqual(v, minorVersion{major: 1, minor: 27}) {
+		t.Errorf("expected 1.27, got %v", v)
+	}
+	if _, ok := parseVersion("latest"); ok {
+		t.Error("expected latest not to be parsed as a version")
+	}
+}
+
+func TestExecAPIVersion(t *testing.T) {
+	testCases := []struct {
+		kubelet  string
+		config   string
+		expected string
+	}{
+		{kubelet: "", expected: "client.authentication.k8s.io/v1alpha1"},
+		{kubelet: "v1.10.13", expected: "client.authentication.k8s.io/v1alpha1"},
+		{kubelet: "v1.11.0", expected: "client.authentication.k8s.io/v1beta1"},
+		{kubelet: "v1.21.14", expected: "client.authentication.k8s.io/v1beta1"},
+		{kubelet: "v1.22.0", expected: "client.authentication.k8s.io/v1"},
+		{kubelet: "v1.27.3", config: "v1beta1", expected: "client.authentication.k8s.io/v1beta1"},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.kubelet+tC.config, func(t *testing.T) {
+			n := Node{KubeletVersion: tC.kubelet, Config: config.Config{ExecAPIVersion: tC.config}}
+			if actual := n.ExecAPIVersion(); actual != tC.expected {
+				t.Errorf("expected %s, got %s", tC.expected, actual)
+			}
+		})
+	}
+}
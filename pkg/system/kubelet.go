@@ -0,0 +1,46 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package system
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+)
+
+// KubeletPath is where the kubelet.service unit expects the kubelet to be installed
+const KubeletPath = "/usr/bin/kubelet"
+
+var kubeletVersionRE = regexp.MustCompile(`^Kubernetes (v\d+\.\d+\.\d+\S*)`)
+
+// KubeletVersion returns the version of the kubelet installed at path e.g. v1.27.3
+func KubeletVersion(path string) (string, error) {
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("couldn't get the version of %s: %v", path, err)
+	}
+	return parseKubeletVersion(string(out))
+}
+
+// parseKubeletVersion parses the output of kubelet --version e.g. Kubernetes v1.27.3-eks-a5565ad
+func parseKubeletVersion(out string) (string, error) {
+	matches := kubeletVersionRE.FindStringSubmatch(out)
+	if matches == nil {
+		return "", fmt.Errorf("couldn't parse the kubelet's version from %q", out)
+	}
+	return matches[1], nil
+}
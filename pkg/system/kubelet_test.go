@@ -0,0 +1,78 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseKubeletVersion(t *testing.T) {
+	testCases := []struct {
+		out      string
+		expected string
+	}{
+		{out: "Kubernetes v1.10.3\n", expected: "v1.10.3"},
+		{out: "Kubernetes v1.27.3-eks-a5565ad\n", expected: "v1.27.3-eks-a5565ad"},
+		{out: "kubelet version unknown\n"},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.out, func(t *testing.T) {
+			version, err := parseKubeletVersion(tC.out)
+			if tC.expected == "" {
+				if err == nil {
+					t.Errorf("expected an error, got %s", version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if version != tC.expected {
+				t.Errorf("expected %s, got %s", tC.expected, version)
+			}
+		})
+	}
+}
+
+func TestKubeletVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kubelet")
+	script := "#!/bin/sh\necho Kubernetes v1.24.16-eks-8ccc7ba\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	version, err := KubeletVersion(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != "v1.24.16-eks-8ccc7ba" {
+		t.Errorf("expected v1.24.16-eks-8ccc7ba, got %s", version)
+	}
+
+	if _, err := KubeletVersion(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error when the kubelet isn't installed")
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/errm/ekstrap/pkg/file"
+
+	"gopkg.in/yaml.v2"
+)
+
+// metaSuffix marks a file as the metadata for the template with the same
+// path (without the suffix), rather than a template itself
+const metaSuffix = ".meta"
+
+// metadataFile sets the permissions and ownership of the file that a
+// template is written to, what is hidden when the changes to it are
+// logged, and what happens when it changes, anything that isn't set keeps
+// its default e.g.
+//
+//	mode: "0644"
+//	uid: 0
+//	gid: 0
+//	dirMode: "0755"
+//	sensitive: false
+//	redactKeys: [token]
+//	redactPEM: true
+//	restart: [containerd.service]
+//	omitEmpty: true
+type metadataFile struct {
+	Mode       *octal   `yaml:"mode"`
+	UID        *int     `yaml:"uid"`
+	GID        *int     `yaml:"gid"`
+	DirMode    *octal   `yaml:"dirMode"`
+	Sensitive  bool     `yaml:"sensitive"`
+	RedactKeys []string `yaml:"redactKeys"`
+	RedactPEM  bool     `yaml:"redactPEM"`
+	Restart    []string `yaml:"restart"`
+	OmitEmpty  bool     `yaml:"omitEmpty"`
+}
+
+// metadata is how the file that a template is written to is written, and
+// what happens when it changes
+type metadata struct {
+	file.Metadata
+	// restart are the units that are restarted when the file changes, the kubelet if there are none
+	restart []string
+	// omitEmpty skips the file if the template renders to nothing but whitespace,
+	// so it isn't written, and is removed if it was written before
+	omitEmpty bool
+}
+
+// octal is a file mode, written in octal like chmod
+type octal os.FileMode
+
+func (o *octal) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 07777 {
+		return fmt.Errorf("%q is not an octal file mode e.g. \"0644\"", s)
+	}
+	*o = octal(mode)
+	return nil
+}
+
+// parseMetadata parses a metadata file, on top of the default metadata
+func parseMetadata(source string) (metadata, error) {
+	meta := metadata{Metadata: file.DefaultMetadata}
+	var m metadataFile
+	if err := yaml.UnmarshalStrict([]byte(source), &m); err != nil {
+		return meta, err
+	}
+	if m.Mode != nil {
+		meta.Mode = os.FileMode(*m.Mode)
+	}
+	if m.UID != nil {
+		meta.UID = *m.UID
+	}
+	if m.GID != nil {
+		meta.GID = *m.GID
+	}
+	if m.DirMode != nil {
+		meta.DirMode = os.FileMode(*m.DirMode)
+	}
+	for _, key := range m.RedactKeys {
+		if key == "" {
+			return meta, errors.New("redactKeys can't contain an empty key")
+		}
+	}
+	for _, unit := range m.Restart {
+		if !strings.Contains(unit, ".") {
+			return meta, fmt.Errorf("restart: %q is not a unit name e.g. containerd.service", unit)
+		}
+	}
+	meta.Redact = file.Redaction{
+		Sensitive: m.Sensitive,
+		Keys:      m.RedactKeys,
+		PEM:       m.RedactPEM,
+	}
+	meta.restart = m.Restart
+	meta.omitEmpty = m.OmitEmpty
+	return meta, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package system
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/errm/ekstrap/pkg/file"
+)
+
+func TestParseMetadata(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		source    string
+		expected  file.Metadata
+		restart   []string
+		omitEmpty bool
+		err       bool
+	}{
+		{
+			desc:     "empty",
+			source:   "",
+			expected: file.Metadata{Mode: 0640, DirMode: 0710},
+		},
+		{
+			desc:     "everything",
+			source:   "mode: \"0600\"\nuid: 1000\ngid: 100\ndirMode: \"0755\"\n",
+			expected: file.Metadata{Mode: 0600, UID: 1000, GID: 100, DirMode: 0755},
+		},
+		{
+			desc:     "unquoted mode",
+			source:   "mode: 0644\n",
+			expected: file.Metadata{Mode: 0644, DirMode: 0710},
+		},
+		{
+			desc:   "redaction",
+			source: "sensitive: true\nredactKeys: [token, password]\nredactPEM: true\n",
+			expected: file.Metadata{Mode: 0640, DirMode: 0710, Redact: file.Redaction{
+				Sensitive: true,
+				Keys:      []string{"token", "password"},
+				PEM:       true,
+			}},
+		},
+		{
+			desc:      "restart and omitEmpty",
+			source:    "restart: [containerd.service]\nomitEmpty: true\n",
+			expected:  file.Metadata{Mode: 0640, DirMode: 0710},
+			restart:   []string{"containerd.service"},
+			omitEmpty: true,
+		},
+		{
+			desc:   "restart without a unit type",
+			source: "restart: [containerd]\n",
+			err:    true,
+		},
+		{
+			desc:   "empty redacted key",
+			source: "redactKeys: [\"\"]\n",
+			err:    true,
+		},
+		{
+			desc:   "invalid mode",
+			source: "mode: rw-r--r--\n",
+			err:    true,
+		},
+		{
+			desc:   "mode too big",
+			source: "mode: \"17777\"\n",
+			err:    true,
+		},
+		{
+			desc:   "unknown field",
+			source: "owner: root\n",
+			err:    true,
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			meta, err := parseMetadata(tC.source)
+			if tC.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(meta.Metadata, tC.expected) {
+				t.Errorf("expected %+v, got %+v", tC.expected, meta.Metadata)
+			}
+			if !reflect.DeepEqual(meta.restart, tC.restart) || meta.omitEmpty != tC.omitEmpty {
+				t.Errorf("expected restart: %v omitEmpty: %v, got restart: %v omitEmpty: %v", tC.restart, tC.omitEmpty, meta.restart, meta.omitEmpty)
+			}
+		})
+	}
+}
@@ -18,22 +18,69 @@ package system
 
 import (
 	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/errm/ekstrap/pkg/file"
 	"github.com/errm/ekstrap/pkg/node"
 	"github.com/gobuffalo/packr/v2"
 
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"text/template"
 )
 
+// DefaultManifest is where the list of files that ekstrap manages is kept
+const DefaultManifest = "/var/lib/ekstrap/manifest.json"
+
+// DefaultGeneration is where the previous generation of the files that ekstrap manages is kept
+const DefaultGeneration = "/var/lib/ekstrap/previous"
+
+// DefaultOverlay is where templates that override, add to, or disable the
+// templates built into ekstrap are read from
+const DefaultOverlay = "/etc/ekstrap/templates.d"
+
+// kubeletUnit is restarted when any file changes, unless its metadata says otherwise
+const kubeletUnit = "kubelet.service"
+
+// disabledSuffix marks a file in the overlay as a tombstone, that stops the
+// template with the same path (without the suffix) from being written
+const disabledSuffix = ".disabled"
+
 type filesystem interface {
-	Sync(io.Reader, string, os.FileMode) error
+	Sync(io.Reader, string, file.Metadata) (bool, error)
+}
+
+// pruner is implemented by filesystems that keep a manifest of the files
+// they manage, so that files which are no longer rendered can be removed
+type pruner interface {
+	Prune(keep []string) (bool, error)
+}
+
+// transactional is implemented by filesystems that stage the files that are
+// synced, until they are all written by Commit
+type transactional interface {
+	Commit() error
+	Rollback() error
+}
+
+// restorer is implemented by filesystems that keep the previous generation
+// of the files that they manage, so that it can be restored
+type restorer interface {
+	Restore(meta map[string]file.Metadata) ([]string, error)
 }
 
 type initsystem interface {
-	EnsureRunning(string) error
+	EnsureRunning(context.Context, string) error
+	EnsureStarted(context.Context, string) error
 }
 
 type hostname interface {
@@ -46,15 +93,164 @@ type System struct {
 	Filesystem filesystem
 	Init       initsystem
 	Hostname   hostname
+	// Overlay is a directory of templates that are merged with the built in
+	// templates by path, it is ignored if it is empty or doesn't exist
+	Overlay string
+	// ForceRestart restarts the kubelet even if none of the files changed
+	ForceRestart bool
 }
 
 // Configure configures the system to connect to the EKS cluster given the node
 // and cluster metadata provided as arguments
-func (s System) Configure(n *node.Node, cluster *eks.Cluster) error {
+//
+// Each unit is only restarted if any of its files changed (the kubelet's are
+// those without a restart in their metadata), and the kubelet is restarted last.
+// Restarting the container runtime restarts the kubelet as well.
+// If the kubelet isn't restarted it is just started, in case it isn't running already.
+//
+// If ctx is done while the units are being restarted, the previous config is
+// restored, as it would be if one of them had failed.
+func (s System) Configure(ctx context.Context, n *node.Node, cluster *eks.Cluster) error {
 	if err := s.Hostname.SetHostname(*n.PrivateDnsName); err != nil {
 		return err
 	}
 
+	units, err := s.write(n, cluster)
+	if err != nil {
+		return err
+	}
+	if s.ForceRestart && !contains(units, kubeletUnit) {
+		units = append(units, kubeletUnit)
+	}
+
+	for _, unit := range units {
+		if err := s.Init.EnsureRunning(ctx, unit); err != nil {
+			return s.rollback(fmt.Errorf("couldn't restart %s: %v", unit, err), units)
+		}
+	}
+	if contains(units, kubeletUnit) {
+		return nil
+	}
+	log.Printf("None of the files for %s changed, so it won't be restarted", kubeletUnit)
+	if err := s.Init.EnsureStarted(ctx, kubeletUnit); err != nil {
+		if len(units) == 0 {
+			return err
+		}
+		return s.rollback(fmt.Errorf("couldn't start %s: %v", kubeletUnit, err), units)
+	}
+	return nil
+}
+
+// RollbackError is returned when the kubelet (or another unit that was
+// restarted) failed with the new config, and the previous config has been restored
+type RollbackError struct {
+	Err error
+	// RestartErr is set if a unit failed with the previous config as well
+	RestartErr error
+}
+
+func (e RollbackError) Error() string {
+	if e.RestartErr != nil {
+		return fmt.Sprintf("%v, the previous config has been restored, but couldn't restart it with the previous config: %v", e.Err, e.RestartErr)
+	}
+	return fmt.Sprintf("%v, the previous config has been restored", e.Err)
+}
+
+// rollback restores the previous versions of the files, and restarts the
+// units with them, after one of them failed with the new ones.
+//
+// The units are restarted even if Configure's context is done, so that they
+// aren't left stopped, or running with the config we just removed.
+func (s System) rollback(err error, units []string) error {
+	tx, ok := s.Filesystem.(transactional)
+	if !ok {
+		return err
+	}
+	log.Printf("%v, restoring the previous config", err)
+	if rerr := tx.Rollback(); rerr != nil {
+		return fmt.Errorf("%v, and couldn't restore the previous config: %v", err, rerr)
+	}
+	for _, unit := range units {
+		if rerr := s.Init.EnsureRunning(context.Background(), unit); rerr != nil {
+			return RollbackError{Err: err, RestartErr: rerr}
+		}
+	}
+	return RollbackError{Err: err}
+}
+
+// Restore writes back the previous generation of config, that was replaced
+// when it was last changed, and restarts the units whose files changed, and
+// then the kubelet.
+//
+// Unlike Configure, nothing is rolled back if a unit fails, as that would
+// just restore the config that we are trying to get away from.
+func (s System) Restore(ctx context.Context) error {
+	r, ok := s.Filesystem.(restorer)
+	tx, isTx := s.Filesystem.(transactional)
+	if !ok || !isTx {
+		return errors.New("the previous generation of config isn't kept, so it can't be restored")
+	}
+	configs, err := s.configs()
+	if err != nil {
+		return err
+	}
+	meta := make(map[string]file.Metadata, len(configs))
+	for _, config := range configs {
+		meta[config.path] = config.meta.Metadata
+	}
+	changed, err := r.Restore(meta)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("couldn't restore the previous config: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't restore the previous config: %v", err)
+	}
+	if len(changed) == 0 {
+		log.Print("The previous config is the same as the current config, so nothing has been restarted")
+		return nil
+	}
+
+	var units []string
+	for _, name := range changed {
+		restart := []string{kubeletUnit}
+		for _, config := range configs {
+			if config.path == name {
+				restart = config.units()
+			}
+		}
+		for _, unit := range restart {
+			if unit != kubeletUnit && !contains(units, unit) {
+				units = append(units, unit)
+			}
+		}
+	}
+	// The kubelet depends on the other units, so it is restarted last
+	units = append(units, kubeletUnit)
+	for _, unit := range units {
+		if err := s.Init.EnsureRunning(ctx, unit); err != nil {
+			return fmt.Errorf("couldn't restart %s with the previous config: %v", unit, err)
+		}
+	}
+	return nil
+}
+
+// Write renders each of the config templates and writes them to the Filesystem.
+//
+// Every template is rendered before anything is written, if the Filesystem is
+// transactional the files are then committed together, so if one can't be
+// written none are.
+//
+// Unlike Configure it doesn't touch the hostname or the init system, so it is
+// safe to use when we only want to see what would be written.
+func (s System) Write(n *node.Node, cluster *eks.Cluster) error {
+	_, err := s.write(n, cluster)
+	return err
+}
+
+// write is like Write, but also returns the units that need to be restarted
+// because their files changed, with the kubelet last
+func (s System) write(n *node.Node, cluster *eks.Cluster) ([]string, error) {
 	info := struct {
 		Cluster *eks.Cluster
 		Node    *node.Node
@@ -65,31 +261,144 @@ func (s System) Configure(n *node.Node, cluster *eks.Cluster) error {
 
 	configs, err := s.configs()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, config := range configs {
-		if config.write(info) != nil {
-			return err
+	rendered := make([]bytes.Buffer, len(configs))
+	for i, config := range configs {
+		if err := config.template.Execute(&rendered[i], info); err != nil {
+			return nil, fmt.Errorf("couldn't render %s: %v", config.path, err)
 		}
 	}
 
-	return s.Init.EnsureRunning("kubelet.service")
+	var units, keep []string
+	kubelet := false
+	// The kubelet Requires= the container runtime, so systemd restarts it
+	// along with the runtime, and it has to be checked (or rolled back) too
+	runtime := n.ContainerRuntime + ".service"
+	restart := func(names []string) {
+		for _, name := range names {
+			if name == kubeletUnit || name == runtime {
+				kubelet = true
+			}
+			if name != kubeletUnit && !contains(units, name) {
+				units = append(units, name)
+			}
+		}
+	}
+	tx, ok := s.Filesystem.(transactional)
+	for i, config := range configs {
+		if config.meta.omitEmpty && len(bytes.TrimSpace(rendered[i].Bytes())) == 0 {
+			continue
+		}
+		changed, err := s.Filesystem.Sync(&rendered[i], config.path, config.meta.Metadata)
+		if err != nil {
+			if ok {
+				tx.Rollback()
+			}
+			return nil, fmt.Errorf("couldn't write %s: %v", config.path, err)
+		}
+		if changed {
+			restart(config.units())
+		}
+		keep = append(keep, config.path)
+	}
+	if p, isPruner := s.Filesystem.(pruner); isPruner {
+		pruned, err := p.Prune(keep)
+		if err != nil {
+			if ok {
+				tx.Rollback()
+			}
+			return nil, fmt.Errorf("couldn't remove the files that are no longer managed: %v", err)
+		}
+		if pruned {
+			restart([]string{kubeletUnit})
+		}
+	}
+	// The kubelet depends on the other units, so it is restarted last
+	if kubelet {
+		units = append(units, kubeletUnit)
+	}
+	if ok {
+		return units, tx.Commit()
+	}
+	return units, nil
 }
 
 func (s System) configs() ([]config, error) {
+	sources, err := s.templates()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(sources))
+	for path := range sources {
+		if !strings.HasSuffix(path, metaSuffix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
 	configs := []config{}
-	box := packr.New("system templates", "./templates")
-	err := box.Walk(func(path string, f packr.File) error {
-		template, err := template.New(path).Funcs(template.FuncMap{"b64dec": base64decode}).Parse(f.String())
+	for _, path := range paths {
+		template, err := template.New(path).Funcs(template.FuncMap{"b64dec": base64decode, "json": toJSON}).Parse(sources[path])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the template for %s: %v", path, err)
+		}
+		meta := metadata{Metadata: file.DefaultMetadata}
+		if source, ok := sources[path+metaSuffix]; ok {
+			if meta, err = parseMetadata(source); err != nil {
+				return nil, fmt.Errorf("couldn't parse the metadata for %s: %v", path, err)
+			}
+		}
 		configs = append(configs, config{
-			template:   template,
-			path:       "/" + path,
-			filesystem: s.Filesystem,
+			template: template,
+			path:     path,
+			meta:     meta,
 		})
-		return err
+	}
+	return configs, nil
+}
+
+// templates returns the source of each template (and metadata file) by the path
+// it is written to, from the packr box, merged with any in the Overlay directory.
+func (s System) templates() (map[string]string, error) {
+	templates := make(map[string]string)
+	box := packr.New("system templates", "./templates")
+	err := box.Walk(func(path string, f packr.File) error {
+		templates["/"+path] = f.String()
+		return nil
 	})
-	return configs, err
+	if err != nil || s.Overlay == "" {
+		return templates, err
+	}
+
+	err = filepath.Walk(s.Overlay, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == s.Overlay && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Overlay, path)
+		if err != nil {
+			return err
+		}
+		target := "/" + filepath.ToSlash(rel)
+		if strings.HasSuffix(target, disabledSuffix) {
+			delete(templates, strings.TrimSuffix(target, disabledSuffix))
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		templates[target] = string(data)
+		return nil
+	})
+	return templates, err
 }
 
 func base64decode(v string) (string, error) {
@@ -100,17 +409,34 @@ func base64decode(v string) (string, error) {
 	return string(data), nil
 }
 
+// toJSON encodes v as JSON, so values can be safely included in JSON files
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
 type config struct {
-	template   *template.Template
-	path       string
-	filesystem filesystem
+	template *template.Template
+	path     string
+	meta     metadata
 }
 
-func (c config) write(data interface{}) error {
-	var buff bytes.Buffer
-	err := c.template.Execute(&buff, data)
-	if err != nil {
-		return err
+// units returns the units that are restarted when the file changes
+func (c config) units() []string {
+	if len(c.meta.restart) == 0 {
+		return []string{kubeletUnit}
+	}
+	return c.meta.restart
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
-	return c.filesystem.Sync(&buff, c.path, 0640)
+	return false
 }
@@ -18,13 +18,22 @@ package system
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/eks"
+	cfg "github.com/errm/ekstrap/pkg/config"
+	"github.com/errm/ekstrap/pkg/file"
 	"github.com/errm/ekstrap/pkg/node"
 )
 
@@ -36,14 +45,14 @@ func TestConfigure(t *testing.T) {
 	i := instance(map[string]string{}, false, "docker")
 	c := cluster()
 	system := System{Filesystem: fs, Hostname: hn, Init: init}
-	err := system.Configure(i, c)
+	err := system.Configure(context.Background(), i, c)
 
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
 
-	if len(fs.files) != 8 {
-		t.Errorf("expected 8 files, got %v", len(fs.files))
+	if len(fs.files) != 9 {
+		t.Errorf("expected 9 files, got %v", len(fs.files))
 	}
 
 	expected := `apiVersion: v1
@@ -64,11 +73,13 @@ users:
   user:
     exec:
       apiVersion: client.authentication.k8s.io/v1alpha1
-      command: aws-iam-authenticator
+      command: /usr/sbin/ekstrap
       args:
         - token
-        - "-i"
+        - "-cluster-name"
         - "aws-om-cluster"
+        - "-region"
+        - "us-east-1"
 `
 	fs.Check(t, "/var/lib/kubelet/kubeconfig", expected, 0640)
 
@@ -95,12 +106,12 @@ KillMode=process
 [Install]
 WantedBy=multi-user.target
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service", expected, 0644)
 
 	expected = `[Service]
 Environment='KUBELET_ARGS=--node-ip=10.6.28.199 --pod-infra-container-image=602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-amd64:3.1'
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service.d/10-kubelet-args.conf", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/10-kubelet-args.conf", expected, 0644)
 
 	expected = `kind: KubeletConfiguration
 apiVersion: kubelet.config.k8s.io/v1beta1
@@ -141,31 +152,364 @@ evictionHard:
 	expected = `[Service]
 Environment='KUBELET_NODE_LABELS=--node-labels="node-role.kubernetes.io/worker=true"'
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service.d/20-labels.conf", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/20-labels.conf", expected, 0644)
 
 	expected = `[Service]`
-	fs.Check(t, "/etc/systemd/system/kubelet.service.d/30-taints.conf", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/30-taints.conf", expected, 0644)
 
 	expected = `[Service]
 Environment="KUBELET_CONTAINER_RUNTIME_ARGS=--container-runtime=docker"
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service.d/40-container-runtime.conf", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/40-container-runtime.conf", expected, 0644)
 
 	expected = `thisisthecertdata
 `
-	fs.Check(t, "/etc/kubernetes/pki/ca.crt", expected, 0640)
+	fs.Check(t, "/etc/kubernetes/pki/ca.crt", expected, 0644)
 
 	if hn.hostname != "ip-10-6-28-199.us-west-2.compute.internal" {
 		t.Errorf("expected hostname to be ip-10-6-28-199.us-west-2.compute.internal, got %v", hn.hostname)
 	}
 
+	expected = `{
+  "bridge": "none",
+  "exec-opts": ["native.cgroupdriver=cgroupfs"],
+  "live-restore": true,
+  "log-driver": "json-file",
+  "log-opts": {
+    "max-size": "10m",
+    "max-file": "10"
+  },
+  "max-concurrent-downloads": 10
+}
+`
+	fs.Check(t, "/etc/docker/daemon.json", expected, 0644)
+
+	if len(init.restarted) != 2 {
+		t.Errorf("expected 2 restarts got %v", len(init.restarted))
+	}
+
+	if init.restarted[0] != "docker.service" || init.restarted[1] != "kubelet.service" {
+		t.Errorf("expected docker and then the kubelet to be restarted, but got %v", init.restarted)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	fs := &FakeFileSystem{}
+
+	i := instance(map[string]string{}, false, "docker")
+	c := cluster()
+	system := System{Filesystem: fs}
+	err := system.Write(i, c)
+
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if len(fs.files) != 9 {
+		t.Errorf("expected 9 files, got %v", len(fs.files))
+	}
+
+	expected := `thisisthecertdata
+`
+	fs.Check(t, "/etc/kubernetes/pki/ca.crt", expected, 0644)
+}
+
+func TestWriteErrors(t *testing.T) {
+	i := instance(map[string]string{}, false, "docker")
+	c := cluster()
+
+	fs := &FakeTransaction{failOn: "/etc/kubernetes/kubelet/config.yaml"}
+	system := System{Filesystem: fs}
+	err := system.Write(i, c)
+	if err == nil || !strings.Contains(err.Error(), "couldn't write /etc/kubernetes/kubelet/config.yaml") {
+		t.Errorf("expected an error writing config.yaml, got %v", err)
+	}
+	if fs.committed || !fs.rolledBack {
+		t.Errorf("expected the transaction to be rolled back, and not committed")
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "etc", "kubernetes", "broken")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("{{.Node.DoesNotExist}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is written if any template can't be rendered
+	fs = &FakeTransaction{}
+	system = System{Filesystem: fs, Overlay: dir}
+	err = system.Write(i, c)
+	if err == nil || !strings.Contains(err.Error(), "couldn't render /etc/kubernetes/broken") {
+		t.Errorf("expected an error rendering the broken template, got %v", err)
+	}
+	if len(fs.files) != 0 {
+		t.Errorf("expected no files to be written, got %v", len(fs.files))
+	}
+}
+
+func TestConfigureRollback(t *testing.T) {
+	fs := &FakeTransaction{}
+	init := &FakeInit{failures: 1}
+
+	system := System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init}
+	err := system.Configure(context.Background(), instance(map[string]string{}, false, "docker"), cluster())
+	rerr, ok := err.(RollbackError)
+	if !ok || rerr.RestartErr != nil {
+		t.Errorf("expected a RollbackError, got %#v", err)
+	}
+	if err == nil || err.Error() != "couldn't restart docker.service: job failed, the previous config has been restored" {
+		t.Errorf("expected an error saying the config was restored, got %v", err)
+	}
+	if !fs.committed || !fs.rolledBack {
+		t.Errorf("expected the transaction to be committed, then rolled back")
+	}
+	if !reflect.DeepEqual(init.restarted, []string{"docker.service", "docker.service", "kubelet.service"}) {
+		t.Errorf("expected docker and the kubelet to be restarted with the previous config, got %v", init.restarted)
+	}
+
+	// The kubelet fails with the previous config too
+	init = &FakeInit{failures: 2}
+	system = System{Filesystem: &FakeTransaction{}, Hostname: &FakeHostname{}, Init: init}
+	err = system.Configure(context.Background(), instance(map[string]string{}, false, "docker"), cluster())
+	if rerr, ok := err.(RollbackError); !ok || rerr.RestartErr == nil {
+		t.Errorf("expected a RollbackError with the error restarting the previous config, got %#v", err)
+	}
+}
+
+func TestConfigureCancelled(t *testing.T) {
+	fs := &FakeTransaction{}
+	init := &FakeInit{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	system := System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init}
+	err := system.Configure(ctx, instance(map[string]string{}, false, "docker"), cluster())
+	if rerr, ok := err.(RollbackError); !ok || rerr.RestartErr != nil {
+		t.Errorf("expected a RollbackError, got %#v", err)
+	}
+	if err == nil || err.Error() != "couldn't restart docker.service: context canceled, the previous config has been restored" {
+		t.Errorf("expected an error saying the config was restored, got %v", err)
+	}
+	if !fs.rolledBack {
+		t.Error("expected the transaction to be rolled back")
+	}
+	expected := []string{"docker.service", "docker.service", "kubelet.service"}
+	if !reflect.DeepEqual(init.restarted, expected) {
+		t.Errorf("expected the units to be restarted with the previous config, got %v", init.restarted)
+	}
+
+	init = &FakeInit{}
+	system = System{Filesystem: &FakeFileSystem{unchanged: true}, Hostname: &FakeHostname{}, Init: init}
+	if err := system.Configure(ctx, instance(map[string]string{}, false, "docker"), cluster()); err != context.Canceled {
+		t.Errorf("expected the kubelet not to be waited for, got %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		restored []string
+		expected []string
+	}{
+		{
+			desc:     "the kubelet's files",
+			restored: []string{"/etc/kubernetes/kubelet/config.yaml", "/var/lib/kubelet/kubeconfig"},
+			expected: []string{"kubelet.service"},
+		},
+		{
+			desc:     "a container runtime's files",
+			restored: []string{"/etc/docker/daemon.json"},
+			expected: []string{"docker.service", "kubelet.service"},
+		},
+		{
+			desc:     "a file that is no longer rendered",
+			restored: []string{"/etc/systemd/system/kubelet.service.d/99-removed.conf"},
+			expected: []string{"kubelet.service"},
+		},
+		{
+			desc: "nothing changed",
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			fs := &FakeTransaction{restored: tC.restored}
+			init := &FakeInit{}
+			system := System{Filesystem: fs, Init: init}
+			if err := system.Restore(context.Background()); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !fs.committed {
+				t.Error("expected the transaction to be committed")
+			}
+			if !reflect.DeepEqual(init.restarted, tC.expected) {
+				t.Errorf("expected %v to be restarted, got %v", tC.expected, init.restarted)
+			}
+			if len(fs.restoreMeta["/var/lib/kubelet/kubeconfig"].Redact.Keys) == 0 {
+				t.Error("expected the kubeconfig to be redacted when it is restored")
+			}
+		})
+	}
+
+	system := System{Filesystem: &FakeFileSystem{}, Init: &FakeInit{}}
+	if err := system.Restore(context.Background()); err == nil {
+		t.Error("expected an error when the previous generation isn't kept")
+	}
+
+	init := &FakeInit{failures: 1}
+	system = System{Filesystem: &FakeTransaction{restored: []string{"/var/lib/kubelet/kubeconfig"}}, Init: init}
+	err := system.Restore(context.Background())
+	if _, ok := err.(RollbackError); ok || err == nil {
+		t.Errorf("expected an error restarting the kubelet, that isn't rolled back, got %#v", err)
+	}
+}
+
+func TestConfigurePermissionsDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "root")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	i := instance(map[string]string{}, false, "containerd")
+	system := System{Filesystem: &file.Transaction{Root: dir}, Hostname: &FakeHostname{}, Init: &FakeInit{}}
+	if err := system.Configure(context.Background(), i, cluster()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ca := filepath.Join(dir, "etc", "kubernetes", "pki", "ca.crt")
+	if err := os.Chmod(ca, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	init := &FakeInit{}
+	system = System{Filesystem: &file.Transaction{Root: dir}, Hostname: &FakeHostname{}, Init: init}
+	if err := system.Configure(context.Background(), i, cluster()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	info, err := os.Stat(ca)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("expected the permissions of ca.crt to be corrected to 0644, got %04o", info.Mode().Perm())
+	}
+	// Only the permissions changed, so nothing needs to be restarted
+	if len(init.restarted) != 0 {
+		t.Errorf("expected nothing to be restarted, got %v", init.restarted)
+	}
+	if !reflect.DeepEqual(init.started, []string{"kubelet.service"}) {
+		t.Errorf("expected the kubelet to be started, got %v", init.started)
+	}
+}
+
+func TestConfigureUnchanged(t *testing.T) {
+	fs := &FakeFileSystem{unchanged: true}
+	init := &FakeInit{}
+
+	system := System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init}
+	if err := system.Configure(context.Background(), instance(map[string]string{}, false, "docker"), cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(init.restarted) != 0 {
+		t.Errorf("expected the kubelet not to be restarted, got %v", init.restarted)
+	}
+	if len(init.started) != 1 || init.started[0] != "kubelet.service" {
+		t.Errorf("expected the kubelet to be started, got %v", init.started)
+	}
+
+	init = &FakeInit{}
+	system = System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init, ForceRestart: true}
+	if err := system.Configure(context.Background(), instance(map[string]string{}, false, "docker"), cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(init.restarted) != 1 || init.restarted[0] != "kubelet.service" {
+		t.Errorf("expected the kubelet to be restarted when forced, got %v", init.restarted)
+	}
+}
+
+func TestConfigurePrune(t *testing.T) {
+	fs := &FakeTransaction{orphans: true}
+	fs.unchanged = true
+	init := &FakeInit{}
+
+	system := System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init}
+	if err := system.Configure(context.Background(), instance(map[string]string{}, false, "docker"), cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(fs.kept) != 9 || fs.kept[0] != "/etc/docker/daemon.json" {
+		t.Errorf("expected the 9 rendered files to be kept, got %v", fs.kept)
+	}
 	if len(init.restarted) != 1 {
-		t.Errorf("expected 1 restart got %v", len(init.restarted))
+		t.Errorf("expected the kubelet to be restarted after a file was removed, got %v", init.restarted)
+	}
+}
+
+func TestConfigureOverrides(t *testing.T) {
+	fs := &FakeFileSystem{}
+
+	i := instance(map[string]string{}, false, "docker")
+	i.Config = cfg.Config{
+		ClusterDNS:   "10.100.0.10",
+		MaxPods:      110,
+		KubeReserved: cfg.Reserved{CPU: "250m", Memory: "2Gi"},
+		EvictionHard: map[string]string{"memory.available": "500Mi", "pid.available": "10%"},
+		PauseImage:   "registry.example.com/pause:3.9",
 	}
+	c := cluster()
+	system := System{Filesystem: fs}
+	err := system.Write(i, c)
 
-	if init.restarted[0] != "kubelet.service" {
-		t.Errorf("expected the kubelet service to be restarted, but got %s", init.restarted[0])
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
 	}
+
+	expected := `[Service]
+Environment='KUBELET_ARGS=--node-ip=10.6.28.199 --pod-infra-container-image=registry.example.com/pause:3.9'
+`
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/10-kubelet-args.conf", expected, 0644)
+
+	expected = `kind: KubeletConfiguration
+apiVersion: kubelet.config.k8s.io/v1beta1
+address: 0.0.0.0
+authentication:
+  anonymous:
+    enabled: false
+  webhook:
+    cacheTTL: 2m0s
+    enabled: true
+  x509:
+    clientCAFile: "/etc/kubernetes/pki/ca.crt"
+authorization:
+  mode: Webhook
+  webhook:
+    cacheAuthorizedTTL: 5m0s
+    cacheUnauthorizedTTL: 30s
+clusterDomain: cluster.local
+hairpinMode: hairpin-veth
+clusterDNS: [10.100.0.10]
+cgroupDriver: cgroupfs
+cgroupRoot: /
+featureGates:
+  RotateKubeletServerCertificate: true
+serverTLSBootstrap: true
+serializeImagePulls: false
+kubeReserved:
+  cpu: 250m
+  memory: 2Gi
+maxPods: 110
+evictionHard:
+  memory.available: 500Mi
+  nodefs.available: 10%
+  nodefs.inodesFree: 5%
+  pid.available: 10%
+`
+	fs.Check(t, "/etc/kubernetes/kubelet/config.yaml", expected, 0640)
 }
 
 func TestConfigureSpotInstanceLabels(t *testing.T) {
@@ -180,7 +524,7 @@ func TestConfigureSpotInstanceLabels(t *testing.T) {
 	i := instance(tags, true, "docker")
 	c := cluster()
 	system := System{Filesystem: fs, Hostname: hn, Init: init}
-	err := system.Configure(i, c)
+	err := system.Configure(context.Background(), i, c)
 
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
@@ -189,7 +533,7 @@ func TestConfigureSpotInstanceLabels(t *testing.T) {
 	expected := `[Service]
 Environment='KUBELET_NODE_LABELS=--node-labels="node-role.kubernetes.io/spot-worker=true"'
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service.d/20-labels.conf", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/20-labels.conf", expected, 0644)
 }
 
 func TestConfigureLabels(t *testing.T) {
@@ -204,7 +548,7 @@ func TestConfigureLabels(t *testing.T) {
 	i := instance(tags, false, "docker")
 	c := cluster()
 	system := System{Filesystem: fs, Hostname: hn, Init: init}
-	err := system.Configure(i, c)
+	err := system.Configure(context.Background(), i, c)
 
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
@@ -213,7 +557,7 @@ func TestConfigureLabels(t *testing.T) {
 	expected := `[Service]
 Environment='KUBELET_NODE_LABELS=--node-labels="gpu-type=K80,node-role.kubernetes.io/worker=true"'
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service.d/20-labels.conf", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/20-labels.conf", expected, 0644)
 }
 
 func TestConfigureTaints(t *testing.T) {
@@ -228,7 +572,7 @@ func TestConfigureTaints(t *testing.T) {
 	i := instance(tags, false, "docker")
 	c := cluster()
 	system := System{Filesystem: fs, Hostname: hn, Init: init}
-	err := system.Configure(i, c)
+	err := system.Configure(context.Background(), i, c)
 
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
@@ -237,7 +581,7 @@ func TestConfigureTaints(t *testing.T) {
 	expected := `[Service]
 Environment='KUBELET_NODE_TAINTS=--register-with-taints="node-role.kubernetes.io/worker=true:PreferNoSchedule"'
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service.d/30-taints.conf", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/30-taints.conf", expected, 0644)
 }
 
 func TestContainerd(t *testing.T) {
@@ -248,7 +592,7 @@ func TestContainerd(t *testing.T) {
 	i := instance(map[string]string{}, false, "containerd")
 	c := cluster()
 	system := System{Filesystem: fs, Hostname: hn, Init: init}
-	err := system.Configure(i, c)
+	err := system.Configure(context.Background(), i, c)
 
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
@@ -277,12 +621,465 @@ KillMode=process
 [Install]
 WantedBy=multi-user.target
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service", expected, 0644)
 
 	expected = `[Service]
 Environment="KUBELET_CONTAINER_RUNTIME_ARGS=--container-runtime=remote --runtime-request-timeout=15m --container-runtime-endpoint=unix:///run/containerd/containerd.sock"
 `
-	fs.Check(t, "/etc/systemd/system/kubelet.service.d/40-container-runtime.conf", expected, 0640)
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/40-container-runtime.conf", expected, 0644)
+
+	expected = `version = 2
+root = "/var/lib/containerd"
+state = "/run/containerd"
+
+[grpc]
+address = "/run/containerd/containerd.sock"
+
+[plugins."io.containerd.grpc.v1.cri"]
+sandbox_image = "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-amd64:3.1"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+default_runtime_name = "runc"
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc]
+runtime_type = "io.containerd.runc.v2"
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc.options]
+SystemdCgroup = false
+
+[plugins."io.containerd.grpc.v1.cri".cni]
+bin_dir = "/opt/cni/bin"
+conf_dir = "/etc/cni/net.d"
+`
+	fs.Check(t, "/etc/containerd/config.toml", expected, 0644)
+
+	if len(init.restarted) != 2 || init.restarted[0] != "containerd.service" || init.restarted[1] != "kubelet.service" {
+		t.Errorf("expected containerd and then the kubelet to be restarted, got %v", init.restarted)
+	}
+}
+
+func TestContainerdConfig(t *testing.T) {
+	fs := &FakeFileSystem{changed: []string{"/etc/containerd/config.toml"}}
+	init := &FakeInit{}
+
+	i := instance(map[string]string{}, false, "containerd")
+	i.Config.CgroupDriver = "systemd"
+	i.Config.RegistryMirrors = map[string][]string{
+		"quay.io":   {"https://quay-mirror.example.com"},
+		"docker.io": {"https://mirror.example.com", "http://10.0.0.1:5000"},
+	}
+	system := System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init}
+	if err := system.Configure(context.Background(), i, cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	config := fs.Contents("/etc/containerd/config.toml")
+	for _, expected := range []string{
+		"SystemdCgroup = true\n",
+		`
+[plugins."io.containerd.grpc.v1.cri".registry.mirrors."docker.io"]
+endpoint = ["https://mirror.example.com", "http://10.0.0.1:5000"]
+
+[plugins."io.containerd.grpc.v1.cri".registry.mirrors."quay.io"]
+endpoint = ["https://quay-mirror.example.com"]
+`,
+	} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("expected the containerd config to contain:\n%s\ngot:\n%s", expected, config)
+		}
+	}
+	if !strings.Contains(fs.Contents("/etc/kubernetes/kubelet/config.yaml"), "cgroupDriver: systemd\n") {
+		t.Errorf("expected the kubelet to use the systemd cgroup driver")
+	}
+
+	// Only containerd's config changed, but the kubelet is restarted along with it
+	if !reflect.DeepEqual(init.restarted, []string{"containerd.service", "kubelet.service"}) {
+		t.Errorf("expected containerd and then the kubelet to be restarted, got %v", init.restarted)
+	}
+	if len(init.started) != 0 {
+		t.Errorf("expected the kubelet not to be started separately, got %v", init.started)
+	}
+
+	// containerd isn't restarted if its config doesn't change
+	fs = &FakeFileSystem{changed: []string{"/etc/kubernetes/kubelet/config.yaml"}}
+	init = &FakeInit{}
+	system = System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init}
+	if err := system.Configure(context.Background(), i, cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(init.restarted) != 1 || init.restarted[0] != "kubelet.service" {
+		t.Errorf("expected only the kubelet to be restarted, got %v", init.restarted)
+	}
+
+	// The containerd config isn't written on nodes using docker
+	fs = &FakeFileSystem{}
+	system = System{Filesystem: fs, Hostname: &FakeHostname{}, Init: &FakeInit{}}
+	if err := system.Configure(context.Background(), instance(map[string]string{}, false, "docker"), cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	for _, f := range fs.files {
+		if f.Path == "/etc/containerd/config.toml" {
+			t.Errorf("expected the containerd config not to be written, got:\n%s", f.Contents)
+		}
+	}
+}
+
+func TestRestartOtherUnits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates.d")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc", "chrony.conf"), []byte("server 169.254.169.123 prefer iburst\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc", "chrony.conf.meta"), []byte("restart: [chronyd.service]\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The kubelet doesn't depend on chronyd, so it isn't restarted with it
+	fs := &FakeFileSystem{changed: []string{"/etc/chrony.conf"}}
+	init := &FakeInit{}
+	system := System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init, Overlay: dir}
+	if err := system.Configure(context.Background(), instance(map[string]string{}, false, "containerd"), cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(init.restarted, []string{"chronyd.service"}) {
+		t.Errorf("expected only chronyd to be restarted, got %v", init.restarted)
+	}
+	if !reflect.DeepEqual(init.started, []string{"kubelet.service"}) {
+		t.Errorf("expected the kubelet to be started, got %v", init.started)
+	}
+}
+
+func TestDockerConfig(t *testing.T) {
+	fs := &FakeFileSystem{changed: []string{"/etc/docker/daemon.json"}}
+	init := &FakeInit{}
+
+	i := instance(map[string]string{}, false, "docker")
+	i.Config.CgroupDriver = "systemd"
+	i.Config.InsecureRegistries = []string{"registry.example.com:5000", "10.0.0.0/8"}
+	i.Config.RegistryMirrors = map[string][]string{
+		"docker.io": {"https://mirror.example.com"},
+		"quay.io":   {"https://quay-mirror.example.com"},
+	}
+	system := System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init}
+	if err := system.Configure(context.Background(), i, cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	var daemon struct {
+		ExecOpts           []string `json:"exec-opts"`
+		InsecureRegistries []string `json:"insecure-registries"`
+		RegistryMirrors    []string `json:"registry-mirrors"`
+		LiveRestore        bool     `json:"live-restore"`
+	}
+	if err := json.Unmarshal([]byte(fs.Contents("/etc/docker/daemon.json")), &daemon); err != nil {
+		t.Fatalf("expected daemon.json to be valid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(daemon.ExecOpts, []string{"native.cgroupdriver=systemd"}) {
+		t.Errorf("expected docker to use the systemd cgroup driver, got %v", daemon.ExecOpts)
+	}
+	if !reflect.DeepEqual(daemon.InsecureRegistries, i.Config.InsecureRegistries) {
+		t.Errorf("expected the insecure registries to be %v, got %v", i.Config.InsecureRegistries, daemon.InsecureRegistries)
+	}
+	// docker only supports mirrors of docker.io
+	if !reflect.DeepEqual(daemon.RegistryMirrors, []string{"https://mirror.example.com"}) {
+		t.Errorf("expected the docker.io mirrors to be used, got %v", daemon.RegistryMirrors)
+	}
+	if !daemon.LiveRestore {
+		t.Error("expected live-restore to be enabled, so containers keep running while docker is restarted")
+	}
+
+	// Only docker's config changed, but the kubelet is restarted along with it
+	if !reflect.DeepEqual(init.restarted, []string{"docker.service", "kubelet.service"}) {
+		t.Errorf("expected docker and then the kubelet to be restarted, got %v", init.restarted)
+	}
+	if len(init.started) != 0 {
+		t.Errorf("expected the kubelet not to be started separately, got %v", init.started)
+	}
+
+	// The docker config isn't written on nodes using containerd
+	fs = &FakeFileSystem{}
+	system = System{Filesystem: fs, Hostname: &FakeHostname{}, Init: &FakeInit{}}
+	if err := system.Configure(context.Background(), instance(map[string]string{}, false, "containerd"), cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	for _, f := range fs.files {
+		if f.Path == "/etc/docker/daemon.json" {
+			t.Errorf("expected the docker config not to be written, got:\n%s", f.Contents)
+		}
+	}
+}
+
+func TestCrio(t *testing.T) {
+	fs := &FakeFileSystem{}
+	init := &FakeInit{}
+
+	i := instance(map[string]string{}, false, "crio")
+	system := System{Filesystem: fs, Hostname: &FakeHostname{}, Init: init}
+	if err := system.Configure(context.Background(), i, cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	expected := `[crio.runtime]
+cgroup_manager = "cgroupfs"
+conmon_cgroup = "pod"
+
+[crio.image]
+pause_image = "602401143452.dkr.ecr.us-east-1.amazonaws.com/eks/pause-amd64:3.1"
+`
+	fs.Check(t, "/etc/crio/crio.conf.d/10-ekstrap.conf", expected, 0644)
+
+	expected = `[Service]
+Environment="KUBELET_CONTAINER_RUNTIME_ARGS=--container-runtime=remote --runtime-request-timeout=15m --container-runtime-endpoint=unix:///var/run/crio/crio.sock"
+`
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/40-container-runtime.conf", expected, 0644)
+
+	if service := fs.Contents("/etc/systemd/system/kubelet.service"); !strings.Contains(service, "After=crio.service\nRequires=crio.service\n") {
+		t.Errorf("expected the kubelet to depend on crio, got:\n%s", service)
+	}
+	for _, f := range fs.files {
+		if f.Path == "/etc/containerd/config.toml" || f.Path == "/etc/docker/daemon.json" {
+			t.Errorf("expected %s not to be written on a crio node", f.Path)
+		}
+	}
+	if !reflect.DeepEqual(init.restarted, []string{"crio.service", "kubelet.service"}) {
+		t.Errorf("expected crio and then the kubelet to be restarted, got %v", init.restarted)
+	}
+
+	// The cgroup manager matches the kubelet's cgroup driver
+	fs = &FakeFileSystem{}
+	i.Config.CgroupDriver = "systemd"
+	system = System{Filesystem: fs, Hostname: &FakeHostname{}, Init: &FakeInit{}}
+	if err := system.Configure(context.Background(), i, cluster()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if config := fs.Contents("/etc/crio/crio.conf.d/10-ekstrap.conf"); !strings.Contains(config, `cgroup_manager = "systemd"`) {
+		t.Errorf("expected crio to use the systemd cgroup manager, got:\n%s", config)
+	}
+}
+
+func TestKubeconfigCommand(t *testing.T) {
+	fs := &FakeFileSystem{}
+	i := instance(map[string]string{}, false, "containerd")
+	i.Config.EkstrapPath = "/opt/bin/ekstrap"
+	if err := (System{Filesystem: fs}).Write(i, cluster()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if kubeconfig := fs.Contents("/var/lib/kubelet/kubeconfig"); !strings.Contains(kubeconfig, "      command: /opt/bin/ekstrap\n") {
+		t.Errorf("expected the kubeconfig to run ekstrap from the configured path, got:\n%s", kubeconfig)
+	}
+
+	// By default the kubelet runs ekstrap from where the README suggests installing it
+	fs = &FakeFileSystem{}
+	i.Config.EkstrapPath = ""
+	if err := (System{Filesystem: fs}).Write(i, cluster()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if kubeconfig := fs.Contents("/var/lib/kubelet/kubeconfig"); !strings.Contains(kubeconfig, "      command: /usr/sbin/ekstrap\n") {
+		t.Errorf("expected the kubeconfig to run /usr/sbin/ekstrap, got:\n%s", kubeconfig)
+	}
+}
+
+func TestWriteOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates.d")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	overlay := map[string]string{
+		// Overrides a built in template
+		"etc/systemd/system/kubelet.service.d/20-labels.conf": "[Service]\nEnvironment='KUBELET_NODE_LABELS=--node-labels=region={{.Node.Region}}'\n",
+		// Adds a new file, with its own metadata
+		"etc/kubernetes/cluster-name":      "{{.Cluster.Name}}\n",
+		"etc/kubernetes/cluster-name.meta": "mode: \"0600\"\n",
+		// Disables a built in template
+		"etc/systemd/system/kubelet.service.d/30-taints.conf.disabled": "",
+	}
+	for path, contents := range overlay {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	fs := &FakeFileSystem{}
+	system := System{Filesystem: fs, Overlay: dir}
+	if err := system.Write(instance(map[string]string{}, false, "docker"), cluster()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if len(fs.files) != 9 {
+		t.Errorf("expected 9 files, got %v", len(fs.files))
+	}
+	fs.Check(t, "/etc/systemd/system/kubelet.service.d/20-labels.conf", "[Service]\nEnvironment='KUBELET_NODE_LABELS=--node-labels=region=us-east-1'\n", 0644)
+	fs.Check(t, "/etc/kubernetes/cluster-name", "aws-om-cluster\n", 0600)
+	fs.Check(t, "/etc/kubernetes/pki/ca.crt", "thisisthecertdata\n", 0644)
+	for _, file := range fs.files {
+		if file.Path == "/etc/systemd/system/kubelet.service.d/30-taints.conf" {
+			t.Error("expected the disabled template not to be written")
+		}
+	}
+
+	// A missing overlay directory is ignored
+	fs = &FakeFileSystem{}
+	system = System{Filesystem: fs, Overlay: filepath.Join(dir, "missing")}
+	if err := system.Write(instance(map[string]string{}, false, "docker"), cluster()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(fs.files) != 9 {
+		t.Errorf("expected 9 files, got %v", len(fs.files))
+	}
+
+	// Errors in overlay templates say which template was wrong
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc/kubernetes/cluster-name"), []byte("{{.Cluster.Name"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	system = System{Filesystem: &FakeFileSystem{}, Overlay: dir}
+	err = system.Write(instance(map[string]string{}, false, "docker"), cluster())
+	if err == nil || !strings.Contains(err.Error(), "couldn't parse the template for /etc/kubernetes/cluster-name") {
+		t.Errorf("expected an error about the invalid template, got %v", err)
+	}
+
+	// An invalid version in an overlay template is an error rendering it
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc/kubernetes/cluster-name"), []byte(`{{ if .Node.KubeletBefore "latest" }}old{{ end }}`), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	system = System{Filesystem: &FakeFileSystem{}, Overlay: dir}
+	err = system.Write(instance(map[string]string{}, false, "docker"), cluster())
+	if err == nil || !strings.Contains(err.Error(), "couldn't render /etc/kubernetes/cluster-name") || !strings.Contains(err.Error(), `invalid version: "latest"`) {
+		t.Errorf("expected an error rendering the template with an invalid version, got %v", err)
+	}
+}
+
+func TestConfigureKubeletVersions(t *testing.T) {
+	testCases := []struct {
+		version   string
+		runtime   string
+		execStart string
+		runtime40 string
+		exec      string
+		labels    string
+	}{
+		{
+			version: "v1.14.9",
+			runtime: "docker",
+			execStart: `ExecStart=/usr/bin/kubelet \
+  --allow-privileged=true \
+  --cloud-provider=aws \
+  --config=/etc/kubernetes/kubelet/config.yaml \
+  --network-plugin=cni \
+  --kubeconfig=`,
+			runtime40: `Environment="KUBELET_CONTAINER_RUNTIME_ARGS=--container-runtime=docker"`,
+			exec:      "apiVersion: client.authentication.k8s.io/v1beta1\n",
+			labels:    `--node-labels="node-role.kubernetes.io/worker=true"`,
+		},
+		{
+			version: "v1.23.17-eks-0a21954",
+			runtime: "containerd",
+			execStart: `ExecStart=/usr/bin/kubelet \
+  --cloud-provider=aws \
+  --config=/etc/kubernetes/kubelet/config.yaml \
+  --network-plugin=cni \
+  --kubeconfig=`,
+			runtime40: "--container-runtime=remote",
+			exec:      "apiVersion: client.authentication.k8s.io/v1\n",
+			labels:    `--node-labels="node.kubernetes.io/worker=true"`,
+		},
+		{
+			version: "1.24",
+			runtime: "containerd",
+			execStart: `ExecStart=/usr/bin/kubelet \
+  --cloud-provider=aws \
+  --config=/etc/kubernetes/kubelet/config.yaml \
+  --kubeconfig=`,
+			runtime40: "--container-runtime=remote",
+			exec:      "apiVersion: client.authentication.k8s.io/v1\n",
+			labels:    `--node-labels="node.kubernetes.io/worker=true"`,
+		},
+		{
+			version: "v1.26.6",
+			runtime: "crio",
+			execStart: `ExecStart=/usr/bin/kubelet \
+  --cloud-provider=aws \
+  --config=/etc/kubernetes/kubelet/config.yaml \
+  --kubeconfig=`,
+			runtime40: "--container-runtime=remote --runtime-request-timeout=15m --container-runtime-endpoint=unix:///var/run/crio/crio.sock",
+			exec:      "apiVersion: client.authentication.k8s.io/v1\n",
+			labels:    `--node-labels="node.kubernetes.io/worker=true"`,
+		},
+		{
+			version: "v1.28.1",
+			runtime: "crio",
+			execStart: `ExecStart=/usr/bin/kubelet \
+  --cloud-provider=external \
+  --config=/etc/kubernetes/kubelet/config.yaml \
+  --kubeconfig=`,
+			exec:   "apiVersion: client.authentication.k8s.io/v1\n",
+			labels: `--node-labels="node.kubernetes.io/worker=true"`,
+		},
+		{
+			version: "v1.27.3",
+			runtime: "containerd",
+			execStart: `ExecStart=/usr/bin/kubelet \
+  --cloud-provider=external \
+  --config=/etc/kubernetes/kubelet/config.yaml \
+  --kubeconfig=`,
+			exec: `      apiVersion: client.authentication.k8s.io/v1
+      command: /usr/sbin/ekstrap
+      args:
+        - token
+        - "-cluster-name"
+        - "aws-om-cluster"
+        - "-region"
+        - "us-east-1"
+      interactiveMode: Never
+      provideClusterInfo: false
+`,
+			labels: `--node-labels="node.kubernetes.io/worker=true"`,
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.version, func(t *testing.T) {
+			fs := &FakeFileSystem{}
+			i := instance(map[string]string{}, false, tC.runtime)
+			i.KubeletVersion = tC.version
+			system := System{Filesystem: fs}
+			if err := system.Write(i, cluster()); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if service := fs.Contents("/etc/systemd/system/kubelet.service"); !strings.Contains(service, tC.execStart) {
+				t.Errorf("expected kubelet.service to contain:\n%s\ngot:\n%s", tC.execStart, service)
+			}
+			dropIn := fs.Contents("/etc/systemd/system/kubelet.service.d/40-container-runtime.conf")
+			if tC.runtime40 == "" && dropIn != "[Service]" {
+				t.Errorf("expected no container runtime args, got:\n%s", dropIn)
+			}
+			if !strings.Contains(dropIn, tC.runtime40) {
+				t.Errorf("expected the container runtime args to contain %s, got:\n%s", tC.runtime40, dropIn)
+			}
+			if kubeconfig := fs.Contents("/var/lib/kubelet/kubeconfig"); !strings.Contains(kubeconfig, tC.exec) {
+				t.Errorf("expected the kubeconfig to contain:\n%s\ngot:\n%s", tC.exec, kubeconfig)
+			}
+			if labels := fs.Contents("/etc/systemd/system/kubelet.service.d/20-labels.conf"); !strings.Contains(labels, tC.labels) {
+				t.Errorf("expected the labels drop-in to contain %s, got:\n%s", tC.labels, labels)
+			}
+			config := fs.Contents("/etc/kubernetes/kubelet/config.yaml")
+			endpoint := "containerRuntimeEndpoint: " + i.RuntimeEndpoint() + "\n"
+			if tC.runtime40 == "" != strings.Contains(config, endpoint) {
+				t.Errorf("expected the container runtime endpoint to be in the kubelet config only when it isn't a flag, got:\n%s", config)
+			}
+		})
+	}
 }
 
 func instance(tags map[string]string, spot bool, runtime string) *node.Node {
@@ -335,16 +1132,23 @@ func cluster() *eks.Cluster {
 
 type FakeFileSystem struct {
 	files []FakeFile
+	// unchanged makes every file look like it already had the same contents
+	unchanged bool
+	// changed, if set, are the only files that look like they have changed
+	changed []string
 }
 
-func (f *FakeFileSystem) Sync(data io.Reader, path string, mode os.FileMode) error {
+func (f *FakeFileSystem) Sync(data io.Reader, path string, meta file.Metadata) (bool, error) {
 	buf := new(bytes.Buffer)
 	if _, err := buf.ReadFrom(data); err != nil {
-		return err
+		return false, err
 	}
 	log.Printf("saving a file to %v", path)
-	f.files = append(f.files, FakeFile{Path: path, Contents: buf.Bytes(), Mode: mode})
-	return nil
+	f.files = append(f.files, FakeFile{Path: path, Contents: buf.Bytes(), Mode: meta.Mode})
+	if f.changed != nil {
+		return contains(f.changed, path), nil
+	}
+	return !f.unchanged, nil
 }
 
 func (f *FakeFileSystem) Check(t *testing.T, path string, contents string, mode os.FileMode) {
@@ -363,6 +1167,54 @@ func (f *FakeFileSystem) Check(t *testing.T, path string, contents string, mode
 	t.Errorf("file not found: %s", path)
 }
 
+func (f *FakeFileSystem) Contents(path string) string {
+	for _, file := range f.files {
+		if file.Path == path {
+			return string(file.Contents)
+		}
+	}
+	return ""
+}
+
+type FakeTransaction struct {
+	FakeFileSystem
+	failOn     string
+	committed  bool
+	rolledBack bool
+	kept       []string
+	orphans    bool
+	// restored are the files that Restore says will change
+	restored    []string
+	restoreMeta map[string]file.Metadata
+}
+
+func (f *FakeTransaction) Restore(meta map[string]file.Metadata) ([]string, error) {
+	f.restoreMeta = meta
+	return f.restored, nil
+}
+
+func (f *FakeTransaction) Prune(keep []string) (bool, error) {
+	f.kept = keep
+	return f.orphans, nil
+}
+
+func (f *FakeTransaction) Sync(data io.Reader, path string, meta file.Metadata) (bool, error) {
+	if path == f.failOn {
+		return false, errors.New("disk full")
+	}
+	return f.FakeFileSystem.Sync(data, path, meta)
+}
+
+func (f *FakeTransaction) Commit() error {
+	f.committed = true
+	return nil
+}
+
+func (f *FakeTransaction) Rollback() error {
+	f.rolledBack = true
+	return nil
+}
+
 type FakeFile struct {
 	Path     string
 	Contents []byte
@@ -380,9 +1232,58 @@ func (h *FakeHostname) SetHostname(name string) error {
 
 type FakeInit struct {
 	restarted []string
+	started   []string
+	failures  int
 }
 
-func (i *FakeInit) EnsureRunning(name string) error {
+func (i *FakeInit) EnsureRunning(ctx context.Context, name string) error {
 	i.restarted = append(i.restarted, name)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if i.failures > 0 {
+		i.failures--
+		return errors.New("job failed")
+	}
 	return nil
 }
+
+func (i *FakeInit) EnsureStarted(ctx context.Context, name string) error {
+	i.started = append(i.started, name)
+	return ctx.Err()
+}
+
+func TestUnitFromCgroup(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		cgroup   string
+		expected string
+	}{
+		{
+			desc:     "cgroup v2",
+			cgroup:   "0::/system.slice/ekstrap.service\n",
+			expected: "ekstrap.service",
+		},
+		{
+			desc:     "cgroup v1",
+			cgroup:   "12:pids:/system.slice/ekstrap.service\n11:cpu,cpuacct:/system.slice/ekstrap.service\n1:name=systemd:/system.slice/ekstrap.service\n",
+			expected: "ekstrap.service",
+		},
+		{
+			desc:   "a login session",
+			cgroup: "0::/user.slice/user-1000.slice/session-3.scope\n",
+		},
+		{
+			desc:   "a container",
+			cgroup: "0::/\n",
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			if unit := unitFromCgroup(tC.cgroup); unit != tC.expected {
+				t.Errorf("expected %q, got %q", tC.expected, unit)
+			}
+		})
+	}
+}
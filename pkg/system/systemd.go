@@ -17,38 +17,315 @@ limitations under the License.
 package system
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-systemd/dbus"
 )
 
+// DefaultStartTimeout is how long we wait for a unit to become active by default
+const DefaultStartTimeout = time.Minute
+
+// DefaultHealthyFor is how long a unit must stay active after it is restarted by default
+const DefaultHealthyFor = 30 * time.Second
+
+// journalLines is the number of lines of a unit's journal included in a UnitError
+const journalLines = 20
+
+// pollInterval is how often we check if a unit has become active
+const pollInterval = 250 * time.Millisecond
+
 type dbusConn interface {
 	Reload() error
 	EnableUnitFiles([]string, bool, bool) (bool, []dbus.EnableUnitFileChange, error)
 	RestartUnit(string, string, chan<- string) (int, error)
+	StartUnit(string, string, chan<- string) (int, error)
 	ListUnits() ([]dbus.UnitStatus, error)
+	GetUnitProperties(string) (map[string]interface{}, error)
+	GetUnitTypeProperties(string, string) (map[string]interface{}, error)
 }
 
 // Systemd allows you to interact with the systemd init system.
 type Systemd struct {
 	Conn dbusConn
+	// StartTimeout is how long to wait for a unit to become active (running)
+	// after it is started, DefaultStartTimeout if it is 0
+	StartTimeout time.Duration
+	// HealthyFor is how long a unit must stay active (running), without being
+	// restarted by systemd, after EnsureRunning restarts it, 0 means it isn't checked
+	HealthyFor time.Duration
+	// Unit is the unit that ekstrap is running in, if any. A job for a unit
+	// that is ordered after it won't run until ekstrap exits, so it isn't waited for
+	Unit string
+}
+
+// UnitError is returned when a unit fails to start, or doesn't become active in time
+type UnitError struct {
+	Unit        string
+	Reason      string
+	ActiveState string
+	SubState    string
+	// ExitCode describes how the unit's main process exited e.g. "status=1" or "signal=9"
+	ExitCode string
+	// Journal is the last few lines of the unit's journal
+	Journal string
+}
+
+func (e UnitError) Error() string {
+	msg := fmt.Sprintf("%s: %s is %s (%s)", e.Reason, e.Unit, e.ActiveState, e.SubState)
+	if e.ExitCode != "" {
+		msg += ", its main process exited with " + e.ExitCode
+	}
+	if e.Journal != "" {
+		msg += ", the last lines of its journal were:\n" + e.Journal
+	}
+	return msg
 }
 
 // EnsureRunning makes sure that the service is running with the latest config.
-func (s *Systemd) EnsureRunning(name string) error {
+//
+// It waits for the service to be restarted, to become active, and then to
+// stay active for HealthyFor, or until ctx is done.
+func (s *Systemd) EnsureRunning(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := s.Conn.Reload(); err != nil {
 		return err
 	}
 	if _, _, err := s.Conn.EnableUnitFiles([]string{name}, false, true); err != nil {
 		return err
 	}
-	_, err := s.Conn.RestartUnit(name, "replace", nil)
+	job := make(chan string, 1)
+	if _, err := s.Conn.RestartUnit(name, "replace", job); err != nil {
+		return err
+	}
+	if s.blocked(name, "restart") {
+		return nil
+	}
+	if err := s.wait(ctx, name, "restart", job); err != nil {
+		return err
+	}
+	return s.watch(ctx, name)
+}
+
+// EnsureStarted makes sure that the service is enabled and running, without
+// reloading systemd or restarting the service if it is already running.
+func (s *Systemd) EnsureStarted(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, _, err := s.Conn.EnableUnitFiles([]string{name}, false, true); err != nil {
+		return err
+	}
+	job := make(chan string, 1)
+	if _, err := s.Conn.StartUnit(name, "replace", job); err != nil {
+		return err
+	}
+	if s.blocked(name, "start") {
+		return nil
+	}
+	return s.wait(ctx, name, "start", job)
+}
+
+// blocked returns true, and logs a warning, if the unit is ordered after the
+// unit that ekstrap is running in, e.g. by Before=kubelet.service in
+// ekstrap.service, as systemd won't run its job until ekstrap has exited
+func (s *Systemd) blocked(name, verb string) bool {
+	if s.Unit == "" {
+		return false
+	}
+	props, err := s.Conn.GetUnitProperties(name)
+	if err != nil {
+		return false
+	}
+	after, _ := props["After"].([]string)
+	for _, unit := range after {
+		if unit == s.Unit {
+			log.Printf("%s is ordered after %s, so it won't %s until ekstrap exits, and won't be checked. Remove Before=%s from %s to fix this", name, s.Unit, verb, name, s.Unit)
+			return true
+		}
+	}
+	return false
+}
+
+// wait waits for the job to finish, and then for the unit to become active
+// (running), it gives up with ctx's error when ctx is done
+func (s *Systemd) wait(ctx context.Context, name, verb string, job <-chan string) error {
+	timeout := s.StartTimeout
+	if timeout == 0 {
+		timeout = DefaultStartTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	select {
+	case result := <-job:
+		if result != "done" {
+			return s.unitError(name, fmt.Sprintf("the job to %s %s finished with the result %q", verb, name, result))
+		}
+	case <-time.After(timeout):
+		return s.unitError(name, fmt.Sprintf("the job to %s %s didn't finish within %s", verb, name, timeout))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for {
+		props, err := s.Conn.GetUnitProperties(name)
+		if err != nil {
+			return err
+		}
+		active, sub := stringProperty(props, "ActiveState"), stringProperty(props, "SubState")
+		if active == "active" && sub == "running" {
+			return nil
+		}
+		if active == "failed" {
+			return s.unitError(name, fmt.Sprintf("%s failed to %s", name, verb))
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return s.unitError(name, fmt.Sprintf("%s didn't become active within %s", name, timeout))
+		}
+		if err := sleep(ctx, remaining); err != nil {
+			return err
+		}
+	}
+}
+
+// watch checks that the unit stays active (running) for HealthyFor, and that
+// systemd doesn't restart it in the meantime, or until ctx is done
+func (s *Systemd) watch(ctx context.Context, name string) error {
+	if s.HealthyFor <= 0 {
+		return nil
+	}
+	restarts, err := s.restarts(name)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.HealthyFor)
+	for {
+		props, err := s.Conn.GetUnitProperties(name)
+		if err != nil {
+			return err
+		}
+		active, sub := stringProperty(props, "ActiveState"), stringProperty(props, "SubState")
+		if active != "active" || sub != "running" {
+			return s.unitError(name, fmt.Sprintf("%s didn't stay active for %s", name, s.HealthyFor))
+		}
+		current, err := s.restarts(name)
+		if err != nil {
+			return err
+		}
+		if current != restarts {
+			return s.unitError(name, fmt.Sprintf("%s was restarted by systemd within %s", name, s.HealthyFor))
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		if err := sleep(ctx, remaining); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for up to pollInterval, or returns ctx's error if it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d > pollInterval {
+		d = pollInterval
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// restarts returns the number of times systemd has automatically restarted
+// the service, older versions of systemd don't count them, so it is always 0
+func (s *Systemd) restarts(name string) (uint32, error) {
+	props, err := s.Conn.GetUnitTypeProperties(name, "Service")
+	if err != nil {
+		return 0, err
+	}
+	restarts, _ := props["NRestarts"].(uint32)
+	return restarts, nil
+}
+
+// unitError describes the state of the unit, and why it failed
+func (s *Systemd) unitError(name, reason string) error {
+	err := UnitError{Unit: name, Reason: reason, ActiveState: "unknown", SubState: "unknown"}
+	if props, perr := s.Conn.GetUnitProperties(name); perr == nil {
+		err.ActiveState = stringProperty(props, "ActiveState")
+		err.SubState = stringProperty(props, "SubState")
+	}
+	if props, perr := s.Conn.GetUnitTypeProperties(name, "Service"); perr == nil {
+		err.ExitCode = exitCode(props)
+	}
+	err.Journal = journalTail(name)
 	return err
 }
 
+func stringProperty(props map[string]interface{}, name string) string {
+	value, _ := props[name].(string)
+	return value
+}
+
+// exitCode describes how the main process of a service exited, using the
+// ExecMainCode and ExecMainStatus properties, which are a CLD_* code, and an
+// exit status or signal number
+func exitCode(props map[string]interface{}) string {
+	code, _ := props["ExecMainCode"].(int32)
+	status, _ := props["ExecMainStatus"].(int32)
+	switch code {
+	case 1: // CLD_EXITED
+		return fmt.Sprintf("status=%d", status)
+	case 2, 3: // CLD_KILLED, CLD_DUMPED
+		return fmt.Sprintf("signal=%d", status)
+	default:
+		return ""
+	}
+}
+
+// journalTail returns the last few lines of the unit's journal
+func journalTail(name string) string {
+	output, err := exec.Command("journalctl", "--unit", name, "--lines", fmt.Sprint(journalLines), "--no-pager", "--output", "cat").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(output), "\n")
+}
+
+// CurrentUnit returns the name of the systemd service that ekstrap is running
+// in, or "" if it isn't running in one e.g. when it is run from a shell
+func CurrentUnit() string {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	return unitFromCgroup(string(data))
+}
+
+// unitFromCgroup finds the service in the contents of /proc/<pid>/cgroup
+func unitFromCgroup(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if unit := path.Base(parts[2]); strings.HasSuffix(unit, ".service") {
+			return unit
+		}
+	}
+	return ""
+}
+
 // SetHostname sets the hostname.
 func (s *Systemd) SetHostname(hostname string) error {
 	if currHostname, err := os.Hostname(); err != nil || currHostname == hostname {
@@ -59,11 +336,12 @@ func (s *Systemd) SetHostname(hostname string) error {
 }
 
 // ContainerRuntime returns the name of a detected running container runtime
-// will detect containerd or docker, errors if cannot determine
+// will detect containerd, docker or crio, errors if cannot determine
 func (s *Systemd) ContainerRuntime() (string, error) {
 	candidates := map[string]string{
 		"containerd.service": "containerd",
 		"docker.service":     "docker",
+		"crio.service":       "crio",
 	}
 	units, err := s.Conn.ListUnits()
 	if err != nil {
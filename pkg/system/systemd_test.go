@@ -17,8 +17,10 @@ limitations under the License.
 package system_test
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/coreos/go-systemd/dbus"
 
@@ -28,9 +30,58 @@ import (
 type fakeDbusConn struct {
 	systemdReloaded bool
 	restartedUnits  []string
+	startedUnits    []string
 	enabledUnits    []string
 	errors          map[string]error
 	unitStatuses    []dbus.UnitStatus
+	// jobResult is the result of restart and start jobs, done if it is empty
+	jobResult string
+	// states are the ActiveState and SubState the unit goes through, the last
+	// is repeated, it is active (running) if there are none
+	states          [][2]string
+	serviceProperty map[string]interface{}
+	// restarts are the values of NRestarts each time it is read, the last is repeated
+	restarts []uint32
+	// after are the units that the unit is ordered after
+	after []string
+	// queued means that jobs never finish, like a job waiting on a unit ordered before it
+	queued bool
+}
+
+func (f *fakeDbusConn) job(ch chan<- string) {
+	if f.queued {
+		return
+	}
+	result := f.jobResult
+	if result == "" {
+		result = "done"
+	}
+	ch <- result
+}
+
+func (f *fakeDbusConn) GetUnitProperties(name string) (map[string]interface{}, error) {
+	state := [2]string{"active", "running"}
+	if len(f.states) > 0 {
+		state = f.states[0]
+	}
+	if len(f.states) > 1 {
+		f.states = f.states[1:]
+	}
+	return map[string]interface{}{"ActiveState": state[0], "SubState": state[1], "After": f.after}, f.errors["properties"]
+}
+
+func (f *fakeDbusConn) GetUnitTypeProperties(name, unitType string) (map[string]interface{}, error) {
+	props := map[string]interface{}{}
+	for k, v := range f.serviceProperty {
+		props[k] = v
+	}
+	if len(f.restarts) > 0 {
+		props["NRestarts"] = f.restarts[0]
+	}
+	if len(f.restarts) > 1 {
+		f.restarts = f.restarts[1:]
+	}
+	return props, nil
 }
 
 func (f *fakeDbusConn) Reload() error {
@@ -45,9 +96,20 @@ func (f *fakeDbusConn) EnableUnitFiles(files []string, runtime, force bool) (boo
 
 func (f *fakeDbusConn) RestartUnit(name string, mode string, ch chan<- string) (int, error) {
 	f.restartedUnits = append(f.restartedUnits, name)
+	if f.errors["restart"] == nil {
+		f.job(ch)
+	}
 	return 0, f.errors["restart"]
 }
 
+func (f *fakeDbusConn) StartUnit(name string, mode string, ch chan<- string) (int, error) {
+	f.startedUnits = append(f.startedUnits, name)
+	if f.errors["start"] == nil {
+		f.job(ch)
+	}
+	return 0, f.errors["start"]
+}
+
 func (f *fakeDbusConn) ListUnits() ([]dbus.UnitStatus, error) {
 	return f.unitStatuses, f.errors["list"]
 }
@@ -72,7 +134,7 @@ func TestEnsureRunning(t *testing.T) {
 			d := &fakeDbusConn{}
 			s := &system.Systemd{Conn: d}
 
-			err := s.EnsureRunning(tC.unit)
+			err := s.EnsureRunning(context.Background(), tC.unit)
 			if err != nil {
 				t.Errorf("Unexpected error:  %v", err)
 			}
@@ -100,6 +162,266 @@ func TestEnsureRunning(t *testing.T) {
 	}
 }
 
+func TestEnsureStarted(t *testing.T) {
+	d := &fakeDbusConn{}
+	s := &system.Systemd{Conn: d}
+
+	if err := s.EnsureStarted(context.Background(), "kubelet.service"); err != nil {
+		t.Errorf("Unexpected error:  %v", err)
+	}
+	if len(d.enabledUnits) != 1 || d.enabledUnits[0] != "kubelet.service" {
+		t.Errorf("Expected kubelet.service to be enabled, got %v", d.enabledUnits)
+	}
+	if len(d.startedUnits) != 1 || d.startedUnits[0] != "kubelet.service" {
+		t.Errorf("Expected kubelet.service to be started, got %v", d.startedUnits)
+	}
+	if len(d.restartedUnits) != 0 {
+		t.Errorf("Expected no units to be restarted, got %v", d.restartedUnits)
+	}
+	if d.systemdReloaded {
+		t.Error("Expected systemd daemon config not to be reloaded, it was")
+	}
+
+	d = &fakeDbusConn{errors: map[string]error{"start": errors.New("Starting a unit is broken")}}
+	s = &system.Systemd{Conn: d}
+	if err := s.EnsureStarted(context.Background(), "kubelet.service"); err != d.errors["start"] {
+		t.Errorf("Got error: %v, expected %v", err, d.errors["start"])
+	}
+}
+
+func TestOrderedAfterEkstrap(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		unit    string
+		after   []string
+		blocked bool
+	}{
+		{desc: "not running in a unit", after: []string{"ekstrap.service"}},
+		{desc: "not ordered after ekstrap", unit: "ekstrap.service", after: []string{"containerd.service"}},
+		{desc: "ordered after ekstrap", unit: "ekstrap.service", after: []string{"containerd.service", "ekstrap.service"}, blocked: true},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			for _, ensure := range []func(*system.Systemd, context.Context, string) error{
+				(*system.Systemd).EnsureRunning,
+				(*system.Systemd).EnsureStarted,
+			} {
+				d := &fakeDbusConn{after: tC.after, queued: true, states: [][2]string{{"inactive", "dead"}}}
+				s := &system.Systemd{Conn: d, Unit: tC.unit, StartTimeout: 10 * time.Millisecond}
+				err := ensure(s, context.Background(), "kubelet.service")
+				if tC.blocked && err != nil {
+					t.Errorf("expected not to wait for kubelet.service, got: %v", err)
+				}
+				if !tC.blocked {
+					if _, ok := err.(system.UnitError); !ok {
+						t.Errorf("expected to wait for kubelet.service and time out, got: %v", err)
+					}
+				}
+				if len(d.restartedUnits)+len(d.startedUnits) != 1 {
+					t.Errorf("expected a job for kubelet.service to be queued, got %v %v", d.restartedUnits, d.startedUnits)
+				}
+			}
+		})
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	testCases := []struct {
+		desc string
+		conn *fakeDbusConn
+	}{
+		{desc: "the job doesn't finish", conn: &fakeDbusConn{queued: true}},
+		{desc: "the unit doesn't become active", conn: &fakeDbusConn{states: [][2]string{{"activating", "start"}}}},
+		{desc: "the unit is being watched"},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			conn := tC.conn
+			if conn == nil {
+				conn = &fakeDbusConn{}
+			}
+			s := &system.Systemd{Conn: conn, HealthyFor: time.Minute}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			if err := s.EnsureRunning(ctx, "kubelet.service"); err != context.DeadlineExceeded {
+				t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("expected to stop waiting when the context was done, took %s", elapsed)
+			}
+		})
+	}
+
+	d := &fakeDbusConn{}
+	s := &system.Systemd{Conn: d}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.EnsureStarted(ctx, "kubelet.service"); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if len(d.startedUnits) != 0 {
+		t.Errorf("expected no jobs to be queued after the context was done, got %v", d.startedUnits)
+	}
+}
+
+func TestWaitForActive(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		conn     *fakeDbusConn
+		timeout  time.Duration
+		expected system.UnitError
+	}{
+		{
+			desc:    "the unit becomes active",
+			conn:    &fakeDbusConn{states: [][2]string{{"activating", "start-pre"}, {"activating", "start"}, {"active", "running"}}},
+			timeout: 5 * time.Second,
+		},
+		{
+			desc: "the job fails",
+			conn: &fakeDbusConn{
+				jobResult:       "failed",
+				states:          [][2]string{{"failed", "failed"}},
+				serviceProperty: map[string]interface{}{"ExecMainCode": int32(1), "ExecMainStatus": int32(255)},
+			},
+			expected: system.UnitError{
+				Unit:        "kubelet.service",
+				Reason:      `the job to restart kubelet.service finished with the result "failed"`,
+				ActiveState: "failed",
+				SubState:    "failed",
+				ExitCode:    "status=255",
+			},
+		},
+		{
+			desc: "the unit crashes after starting",
+			conn: &fakeDbusConn{
+				states:          [][2]string{{"activating", "start"}, {"failed", "failed"}},
+				serviceProperty: map[string]interface{}{"ExecMainCode": int32(2), "ExecMainStatus": int32(9)},
+			},
+			expected: system.UnitError{
+				Unit:        "kubelet.service",
+				Reason:      "kubelet.service failed to restart",
+				ActiveState: "failed",
+				SubState:    "failed",
+				ExitCode:    "signal=9",
+			},
+		},
+		{
+			desc: "the unit doesn't become active in time",
+			conn: &fakeDbusConn{states: [][2]string{{"activating", "auto-restart"}}},
+			expected: system.UnitError{
+				Unit:        "kubelet.service",
+				Reason:      "kubelet.service didn't become active within 50ms",
+				ActiveState: "activating",
+				SubState:    "auto-restart",
+			},
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			timeout := tC.timeout
+			if timeout == 0 {
+				timeout = 50 * time.Millisecond
+			}
+			s := &system.Systemd{Conn: tC.conn, StartTimeout: timeout}
+			err := s.EnsureRunning(context.Background(), "kubelet.service")
+			if tC.expected.Unit == "" {
+				if err != nil {
+					t.Errorf("Unexpected error:  %v", err)
+				}
+				return
+			}
+			uerr, ok := err.(system.UnitError)
+			if !ok {
+				t.Fatalf("Expected a UnitError, got %v", err)
+			}
+			// The journal depends on the machine the tests are run on
+			uerr.Journal = ""
+			if uerr != tC.expected {
+				t.Errorf("Expected %#v, got %#v", tC.expected, uerr)
+			}
+		})
+	}
+}
+
+func TestStaysHealthy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		conn     *fakeDbusConn
+		expected system.UnitError
+	}{
+		{
+			desc: "the unit stays active",
+			conn: &fakeDbusConn{restarts: []uint32{2}},
+		},
+		{
+			desc: "the unit crashes",
+			conn: &fakeDbusConn{
+				states:          [][2]string{{"active", "running"}, {"active", "running"}, {"failed", "failed"}},
+				serviceProperty: map[string]interface{}{"ExecMainCode": int32(1), "ExecMainStatus": int32(1)},
+			},
+			expected: system.UnitError{
+				Unit:        "kubelet.service",
+				Reason:      "kubelet.service didn't stay active for 1s",
+				ActiveState: "failed",
+				SubState:    "failed",
+				ExitCode:    "status=1",
+			},
+		},
+		{
+			desc: "the unit is restarted by systemd",
+			conn: &fakeDbusConn{restarts: []uint32{0, 0, 1}},
+			expected: system.UnitError{
+				Unit:        "kubelet.service",
+				Reason:      "kubelet.service was restarted by systemd within 1s",
+				ActiveState: "active",
+				SubState:    "running",
+			},
+		},
+	}
+	for _, tC := range testCases {
+		tC := tC
+		t.Run(tC.desc, func(t *testing.T) {
+			s := &system.Systemd{Conn: tC.conn, StartTimeout: time.Second, HealthyFor: time.Second}
+			err := s.EnsureRunning(context.Background(), "kubelet.service")
+			if tC.expected.Unit == "" {
+				if err != nil {
+					t.Errorf("Unexpected error:  %v", err)
+				}
+				return
+			}
+			uerr, ok := err.(system.UnitError)
+			if !ok {
+				t.Fatalf("Expected a UnitError, got %v", err)
+			}
+			uerr.Journal = ""
+			if uerr != tC.expected {
+				t.Errorf("Expected %#v, got %#v", tC.expected, uerr)
+			}
+		})
+	}
+}
+
+func TestUnitError(t *testing.T) {
+	err := system.UnitError{
+		Unit:        "kubelet.service",
+		Reason:      "kubelet.service failed to restart",
+		ActiveState: "failed",
+		SubState:    "failed",
+		ExitCode:    "status=1",
+		Journal:     "F1017 kubelet.go:1380] failed to run Kubelet",
+	}
+	expected := `kubelet.service failed to restart: kubelet.service is failed (failed), its main process exited with status=1, the last lines of its journal were:
+F1017 kubelet.go:1380] failed to run Kubelet`
+	if err.Error() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, err.Error())
+	}
+}
+
 func TestErrorHandling(t *testing.T) {
 	testCases := []struct {
 		desc string
@@ -129,7 +451,7 @@ func TestErrorHandling(t *testing.T) {
 			errs[tC.name] = tC.err
 			d := &fakeDbusConn{errors: errs}
 			s := &system.Systemd{Conn: d}
-			err := s.EnsureRunning("kubelet.service")
+			err := s.EnsureRunning(context.Background(), "kubelet.service")
 			if err != tC.err {
 				t.Errorf("Got error: %v, expected %v", err, tC.err)
 			}
@@ -163,6 +485,16 @@ func TestContainerRuntime(t *testing.T) {
 			},
 			expected: "containerd",
 		},
+		{
+			desc: "When crio is loaded",
+			unitStatuses: []dbus.UnitStatus{
+				{
+					Name:      "crio.service",
+					LoadState: "loaded",
+				},
+			},
+			expected: "crio",
+		},
 		{
 			desc: "When containerd is loaded but a docker unit is also listed (but not loaded)",
 			unitStatuses: []dbus.UnitStatus{
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Edward Robinson.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package token
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const (
+	// prefix identifies the version of the token format
+	prefix = "k8s-aws-v1."
+
+	// clusterIDHeader binds the token to a single cluster
+	clusterIDHeader = "x-k8s-aws-id"
+
+	// presignExpiry is what aws-iam-authenticator uses, EKS ignores it
+	// and accepts tokens for lifetime after they were signed
+	presignExpiry = 60 * time.Second
+	lifetime      = 15 * time.Minute
+)
+
+// Generator generates bearer tokens that authenticate with EKS as the
+// identity of some AWS credentials, like aws-iam-authenticator does.
+//
+// A token is a presigned sts:GetCallerIdentity request, that EKS makes to
+// find out who we are.
+type Generator struct {
+	Credentials *credentials.Credentials
+	// Region is the region of the STS endpoint to use, if it is empty the global endpoint is used
+	Region string
+
+	now func() time.Time
+}
+
+// Token is a bearer token for an EKS cluster
+type Token struct {
+	Token string
+	// Expiration is a little before the token stops being accepted, so it can be refreshed in time
+	Expiration time.Time
+}
+
+// Get returns a token for the named cluster
+func (g Generator) Get(clusterName string) (Token, error) {
+	region := g.Region
+	host := "sts.amazonaws.com"
+	if region == "" {
+		region = "us-east-1"
+	} else {
+		host = "sts." + region + ".amazonaws.com"
+		if strings.HasPrefix(region, "cn-") {
+			host += ".cn"
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+host+"/?Action=GetCallerIdentity&Version=2011-06-15", nil)
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set(clusterIDHeader, clusterName)
+
+	now := g.clock()
+	signer := v4.NewSigner(g.Credentials)
+	if _, err := signer.Presign(req, nil, "sts", region, presignExpiry, now); err != nil {
+		return Token{}, err
+	}
+	return Token{
+		Token:      prefix + base64.RawURLEncoding.EncodeToString([]byte(req.URL.String())),
+		Expiration: now.Add(lifetime - time.Minute),
+	}, nil
+}
+
+func (g Generator) clock() time.Time {
+	if g.now != nil {
+		return g.now()
+	}
+	return time.Now()
+}
+
+// execCredential is the output of a client-go credential plugin
+//
+// see https://kubernetes.io/docs/reference/access-authn-authz/authentication/#client-go-credential-plugins
+type execCredential struct {
+	Kind       string               `json:"kind"`
+	APIVersion string               `json:"apiVersion"`
+	Spec       struct{}             `json:"spec"`
+	Status     execCredentialStatus `json:"status"`
+}
+
+type execCredentialStatus struct {
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	Token               string    `json:"token"`
+}
+
+// DefaultAPIVersion is the ExecCredential version used when client-go doesn't tell us which to use
+const DefaultAPIVersion = "client.authentication.k8s.io/v1alpha1"
+
+// APIVersion returns the version of ExecCredential that client-go expects, given the
+// value of KUBERNETES_EXEC_INFO, that it sets when it runs a credential plugin.
+func APIVersion(execInfo string) string {
+	var info struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := json.Unmarshal([]byte(execInfo), &info); err != nil || info.APIVersion == "" {
+		return DefaultAPIVersion
+	}
+	return info.APIVersion
+}
+
+// WriteExecCredential writes the token as an ExecCredential, so ekstrap can be
+// used as an exec credential plugin in a kubeconfig.
+func (t Token) WriteExecCredential(w io.Writer, apiVersion string) error {
+	return json.NewEncoder(w).Encode(execCredential{
+		Kind:       "ExecCredential",
+		APIVersion: apiVersion,
+		Status: execCredentialStatus{
+			ExpirationTimestamp: t.Expiration.UTC().Truncate(time.Second),
+			Token:               t.Token,
+		},
+	})
+}